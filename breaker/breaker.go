@@ -0,0 +1,206 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// Config : circuit breaker
+type Config struct {
+	// consecutive failures to open the circuit. default 5
+	FailureThreshold int `yaml:"failure_threshold"`
+	// how long the circuit stays open before probing. default 30s
+	OpenDuration time.Duration `yaml:"open_duration"`
+	// concurrent probe requests in half-open state. default 1
+	HalfOpenRequests int `yaml:"half_open_requests"`
+	// successful probes to close the circuit. default 1
+	SuccessThreshold int `yaml:"success_threshold"`
+}
+
+// SetDefaults : fill default values
+func (c *Config) SetDefaults() {
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = 5
+	}
+	if c.OpenDuration <= 0 {
+		c.OpenDuration = 30 * time.Second
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = 1
+	}
+	if c.SuccessThreshold <= 0 {
+		c.SuccessThreshold = 1
+	}
+}
+
+// State : state of circuit
+type State int
+
+// States of circuit
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+// Outcome : result of an allowed request
+type Outcome int
+
+// Outcomes of request
+const (
+	// request was not completed by a reason unrelated to destination
+	// (e.g. client closed request). releases probe slot only
+	Ignored Outcome = iota
+	Success
+	Failure
+)
+
+// Stats : state and transition counts of circuit
+type Stats struct {
+	State          string    `json:"state"`
+	Failures       int       `json:"failures"`
+	Opened         uint64    `json:"opened"`
+	HalfOpened     uint64    `json:"half_opened"`
+	Closed         uint64    `json:"closed"`
+	LastTransition time.Time `json:"last_transition,omitempty"`
+}
+
+// Breaker : closed/open/half-open circuit breaker
+type Breaker struct {
+	cfg      Config
+	onChange func(from, to State)
+
+	mu        sync.Mutex
+	state     State
+	failures  int
+	successes int
+	probes    int
+	openedAt  time.Time
+	stats     Stats
+}
+
+// New : onChange is called on every state transition with breaker's lock held
+func New(cfg Config, onChange func(from, to State)) *Breaker {
+	cfg.SetDefaults()
+	return &Breaker{
+		cfg:      cfg,
+		onChange: onChange,
+	}
+}
+
+// Ready : whether Allow would succeed now. does not change state
+func (b *Breaker) Ready(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Open:
+		return now.Sub(b.openedAt) >= b.cfg.OpenDuration
+	case HalfOpen:
+		return b.probes < b.cfg.HalfOpenRequests
+	}
+	return true
+}
+
+// Allow : whether a request may be sent. if allowed, done must be called
+// exactly once with the outcome of the request
+func (b *Breaker) Allow() (done func(Outcome), ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case Closed:
+		return b.doneClosed, true
+	case Open:
+		if now.Sub(b.openedAt) < b.cfg.OpenDuration {
+			return nil, false
+		}
+		b.transit(HalfOpen, now)
+	}
+	if b.probes >= b.cfg.HalfOpenRequests {
+		return nil, false
+	}
+	b.probes++
+	return b.doneProbe, true
+}
+
+func (b *Breaker) doneClosed(o Outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != Closed || o == Ignored {
+		// ignored, or started before the circuit opened
+		return
+	}
+	if o == Success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.cfg.FailureThreshold {
+		b.transit(Open, time.Now())
+	}
+}
+
+func (b *Breaker) doneProbe(o Outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probes--
+	if b.state != HalfOpen || o == Ignored {
+		return
+	}
+	if o == Failure {
+		b.transit(Open, time.Now())
+		return
+	}
+	b.successes++
+	if b.successes >= b.cfg.SuccessThreshold {
+		b.transit(Closed, time.Now())
+	}
+}
+
+// transit : must be called with b.mu held
+func (b *Breaker) transit(to State, now time.Time) {
+	from := b.state
+	b.state = to
+	b.successes = 0
+	switch to {
+	case Open:
+		b.openedAt = now
+		b.stats.Opened++
+	case HalfOpen:
+		b.stats.HalfOpened++
+	case Closed:
+		b.failures = 0
+		b.stats.Closed++
+	}
+	b.stats.LastTransition = now
+	if b.onChange != nil {
+		b.onChange(from, to)
+	}
+}
+
+// State : current state
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Stats : current state and transition counts
+func (b *Breaker) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.stats
+	st.State = b.state.String()
+	st.Failures = b.failures
+	return st
+}
@@ -0,0 +1,100 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	var transitions []string
+	b := New(Config{FailureThreshold: 3, OpenDuration: 50 * time.Millisecond, HalfOpenRequests: 2}, func(from, to State) {
+		transitions = append(transitions, from.String()+">"+to.String())
+	})
+	fail := func() {
+		done, ok := b.Allow()
+		assert.True(t, ok)
+		done(Failure)
+	}
+
+	fail()
+	fail()
+	done, _ := b.Allow()
+	done(Success)
+	fail()
+	fail()
+	assert.Equal(t, Closed, b.State())
+	fail()
+	assert.Equal(t, Open, b.State())
+	_, ok := b.Allow()
+	assert.False(t, ok)
+	assert.False(t, b.Ready(time.Now()))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, b.Ready(time.Now()))
+	p1, ok := b.Allow()
+	assert.True(t, ok)
+	assert.Equal(t, HalfOpen, b.State())
+	p2, ok := b.Allow()
+	assert.True(t, ok)
+	_, ok = b.Allow()
+	assert.False(t, ok)
+
+	// ignored probe releases its slot only
+	p1(Ignored)
+	assert.Equal(t, HalfOpen, b.State())
+	p1, ok = b.Allow()
+	assert.True(t, ok)
+	p1(Failure)
+	assert.Equal(t, Open, b.State())
+	// outcome of a probe after reopened is not counted
+	p2(Success)
+	assert.Equal(t, Open, b.State())
+
+	time.Sleep(60 * time.Millisecond)
+	p1, ok = b.Allow()
+	assert.True(t, ok)
+	p1(Success)
+	assert.Equal(t, Closed, b.State())
+
+	assert.Equal(t, []string{
+		"closed>open", "open>half_open", "half_open>open",
+		"open>half_open", "half_open>closed",
+	}, transitions)
+	st := b.Stats()
+	assert.Equal(t, "closed", st.State)
+	assert.Equal(t, uint64(2), st.Opened)
+	assert.Equal(t, uint64(2), st.HalfOpened)
+	assert.Equal(t, uint64(1), st.Closed)
+}
+
+func TestGroup(t *testing.T) {
+	var opened []string
+	g := NewGroup(Config{FailureThreshold: 1, OpenDuration: time.Hour}, func(key string, from, to State) {
+		if to == Open {
+			opened = append(opened, key)
+		}
+	})
+	done, ok := g.Allow("a.example:443")
+	assert.True(t, ok)
+	done(Failure)
+	_, ok = g.Allow("a.example:443")
+	assert.False(t, ok)
+	done, ok = g.Allow("b.example:80")
+	assert.True(t, ok)
+	done(Success)
+
+	assert.Equal(t, []string{"a.example:443"}, opened)
+	st := g.Stats()
+	assert.Equal(t, "open", st["a.example:443"].State)
+	assert.Equal(t, "closed", st["b.example:80"].State)
+
+	// idle closed breakers are removed
+	g.mu.Lock()
+	g.sweep(time.Now().Add(groupIdleTimeout + time.Second))
+	g.mu.Unlock()
+	st = g.Stats()
+	assert.Len(t, st, 1)
+	assert.Contains(t, st, "a.example:443")
+}
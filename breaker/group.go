@@ -0,0 +1,79 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// idle closed breakers are removed after this
+const groupIdleTimeout = 10 * time.Minute
+
+type groupEntry struct {
+	breaker  *Breaker
+	lastUsed time.Time
+}
+
+// Group : breakers by key, created on first use
+type Group struct {
+	cfg      Config
+	onChange func(key string, from, to State)
+
+	mu        sync.Mutex
+	breakers  map[string]*groupEntry
+	lastSweep time.Time
+}
+
+// NewGroup : onChange is called on every state transition of a breaker
+func NewGroup(cfg Config, onChange func(key string, from, to State)) *Group {
+	cfg.SetDefaults()
+	return &Group{
+		cfg:       cfg,
+		onChange:  onChange,
+		breakers:  make(map[string]*groupEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow : Allow of the breaker of key
+func (g *Group) Allow(key string) (done func(Outcome), ok bool) {
+	now := time.Now()
+	g.mu.Lock()
+	if now.Sub(g.lastSweep) > groupIdleTimeout {
+		g.sweep(now)
+	}
+	e, found := g.breakers[key]
+	if !found {
+		var onChange func(from, to State)
+		if g.onChange != nil {
+			onChange = func(from, to State) {
+				g.onChange(key, from, to)
+			}
+		}
+		e = &groupEntry{breaker: New(g.cfg, onChange)}
+		g.breakers[key] = e
+	}
+	e.lastUsed = now
+	g.mu.Unlock()
+	return e.breaker.Allow()
+}
+
+// sweep : remove idle closed breakers. must be called with g.mu held
+func (g *Group) sweep(now time.Time) {
+	g.lastSweep = now
+	for key, e := range g.breakers {
+		if now.Sub(e.lastUsed) > groupIdleTimeout && e.breaker.State() == Closed {
+			delete(g.breakers, key)
+		}
+	}
+}
+
+// Stats : stats of breakers by key
+func (g *Group) Stats() map[string]Stats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st := make(map[string]Stats, len(g.breakers))
+	for key, e := range g.breakers {
+		st[key] = e.breaker.Stats()
+	}
+	return st
+}
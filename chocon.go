@@ -17,8 +17,11 @@ import (
 	stats_api "github.com/fukata/golang-stats-api-handler"
 	"github.com/jessevdk/go-flags"
 	"github.com/kazeburo/chocon/accesslog"
+	"github.com/kazeburo/chocon/breaker"
+	"github.com/kazeburo/chocon/keepalive"
 	"github.com/kazeburo/chocon/pidfile"
 	"github.com/kazeburo/chocon/proxy"
+	"github.com/kazeburo/chocon/router"
 	"github.com/kazeburo/chocon/upstream"
 	ss "github.com/lestrrat/go-server-starter-listener"
 	statsHTTP "github.com/mercari/go-httpstats"
@@ -30,29 +33,68 @@ var (
 	version string
 )
 
+const (
+	defaultUpstreamName = "default"
+	backupUpstreamName  = "backup"
+)
+
 type cmdOpts struct {
-	Listen           string        `short:"l" long:"listen" default:"0.0.0.0" description:"address to bind"`
-	Port             string        `short:"p" long:"port" default:"3000" description:"Port number to bind"`
-	LogDir           string        `long:"access-log-dir" default:"" description:"directory to store logfiles"`
-	LogRotate        int64         `long:"access-log-rotate" default:"30" description:"Number of rotation before remove logs"`
-	LogRotateTime    int64         `long:"access-log-rotate-time" default:"1440" description:"Interval minutes between file rotation"`
-	Version          bool          `short:"v" long:"version" description:"Show version"`
-	PidFile          string        `long:"pid-file" default:"" description:"filename to store pid. disabled by default"`
-	KeepaliveConns   int           `short:"c" default:"2" long:"keepalive-conns" description:"maximum keepalive connections for upstream"`
-	MaxConnsPerHost  int           `long:"max-conns-per-host" default:"0" description:"maximum connections per host"`
-	ReadTimeout      int           `long:"read-timeout" default:"30" description:"timeout of reading request"`
-	WriteTimeout     int           `long:"write-timeout" default:"90" description:"timeout of writing response"`
-	ProxyReadTimeout int           `long:"proxy-read-timeout" default:"60" description:"timeout of reading response from upstream"`
-	ShutdownTimeout  time.Duration `long:"shutdown-timeout" default:"1h"  description:"timeout to wait for all connections to be closed."`
-	Upstream         string        `long:"upstream" default:"" description:"upstream server: http://upstream-server/"`
-	StatsBufsize     int           `long:"stsize" default:"1000" description:"buffer size for http stats"`
-	StatsSpfactor    int           `long:"spfactor" default:"3" description:"sampling factor for http stats"`
+	Listen                  string        `short:"l" long:"listen" default:"0.0.0.0" description:"address to bind"`
+	Port                    string        `short:"p" long:"port" default:"3000" description:"Port number to bind"`
+	LogDir                  string        `long:"access-log-dir" default:"" description:"directory to store logfiles"`
+	LogRotate               int64         `long:"access-log-rotate" default:"30" description:"Number of rotation before remove logs"`
+	LogRotateTime           int64         `long:"access-log-rotate-time" default:"1440" description:"Interval minutes between file rotation"`
+	Version                 bool          `short:"v" long:"version" description:"Show version"`
+	PidFile                 string        `long:"pid-file" default:"" description:"filename to store pid. disabled by default"`
+	KeepaliveConns          int           `short:"c" default:"2" long:"keepalive-conns" description:"maximum keepalive connections for upstream"`
+	MaxConnsPerHost         int           `long:"max-conns-per-host" default:"0" description:"maximum connections per host"`
+	ReadTimeout             int           `long:"read-timeout" default:"30" description:"timeout of reading request"`
+	WriteTimeout            int           `long:"write-timeout" default:"90" description:"timeout of writing response"`
+	ProxyReadTimeout        int           `long:"proxy-read-timeout" default:"60" description:"timeout of reading response from upstream"`
+	MaxConnAge              time.Duration `long:"max-conn-age" default:"0" description:"upstream connections older than this are closed after their next request. 0 disables"`
+	MaxConnAgeJitter        int           `long:"max-conn-age-jitter" default:"10" description:"percentage of max-conn-age to shorten randomly. 0-100"`
+	MaxConnRequests         int64         `long:"max-conn-requests" default:"0" description:"upstream connections are closed after this number of requests. 0 disables"`
+	ShutdownTimeout         time.Duration `long:"shutdown-timeout" default:"1h"  description:"timeout to wait for all connections to be closed."`
+	Upstream                string        `long:"upstream" default:"" description:"upstream server: http://upstream-server/"`
+	StripPrefix             string        `long:"strip-prefix" default:"" description:"prefix removed from request path before sending to --upstream"`
+	BackupUpstream          string        `long:"backup-upstream" default:"" description:"upstream server used while --upstream has no usable IPs"`
+	Config                  string        `long:"config" default:"" description:"YAML or JSON file of upstream pools and routes"`
+	Zone                    string        `long:"zone" default:"" description:"zone of this host. default local zone of upstream pools with zone aware routing"`
+	StatsBufsize            int           `long:"stsize" default:"1000" description:"buffer size for http stats"`
+	StatsSpfactor           int           `long:"spfactor" default:"3" description:"sampling factor for http stats"`
+	BreakerFailures         int           `long:"ccnproxy-breaker-failures" default:"0" description:"consecutive failures to open circuit breaker of a ccnproxy destination. 0 disables"`
+	BreakerOpenDuration     time.Duration `long:"ccnproxy-breaker-open-duration" default:"30s" description:"duration circuit breaker of a ccnproxy destination stays open"`
+	BreakerHalfOpenRequests int           `long:"ccnproxy-breaker-half-open-requests" default:"1" description:"concurrent probe requests to a ccnproxy destination with half-open circuit"`
 }
 
-func addStatsHandler(h http.Handler, mw *statsHTTP.Metrics) http.Handler {
+func addStatsHandler(h http.Handler, mw *statsHTTP.Metrics, rt *router.Router, breakers *breaker.Group) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.Index(r.URL.Path, "/.api/stats") == 0 {
 			stats_api.Handler(w, r)
+		} else if strings.Index(r.URL.Path, "/.api/upstreams") == 0 {
+			upstreams := rt.Upstreams()
+			d := make([]*upstream.Status, len(upstreams))
+			for i, u := range upstreams {
+				d[i] = u.Status()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(d); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		} else if strings.Index(r.URL.Path, "/.api/splits") == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(rt.Splits()); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		} else if strings.Index(r.URL.Path, "/.api/ccnproxy-breakers") == 0 {
+			d := map[string]breaker.Stats{}
+			if breakers != nil {
+				d = breakers.Stats()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(d); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
 		} else if strings.Index(r.URL.Path, "/.api/http-stats") == 0 {
 			d, err := mw.Data()
 			if err != nil {
@@ -79,14 +121,24 @@ func wrapStatsHandler(h http.Handler, mw *statsHTTP.Metrics) http.Handler {
 	return mw.WrapHandleFunc(h)
 }
 
-func makeTransport(keepaliveConns int, maxConnsPerHost int, proxyReadTimeout int) http.RoundTripper {
-	return &http.Transport{
+func makeTransport(keepaliveConns int, maxConnsPerHost int, proxyReadTimeout int, lifetime keepalive.Config, u *upstream.Upstream) http.RoundTripper {
+	// dialer races IPv4 and IPv6 addresses of a hostname (Happy Eyeballs)
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	if u != nil {
+		// upstream gives up the chosen IP after happy eyeballs delay
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return u.DialContext(ctx, dialer, network, addr)
+		}
+	}
+	dial = lifetime.WrapDial(dial)
+	transport := &http.Transport{
 		// inherited http.DefaultTransport
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
 		IdleConnTimeout:       30 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
@@ -95,6 +147,11 @@ func makeTransport(keepaliveConns int, maxConnsPerHost int, proxyReadTimeout int
 		MaxConnsPerHost:       maxConnsPerHost,
 		ResponseHeaderTimeout: time.Duration(proxyReadTimeout) * time.Second,
 	}
+	if u != nil && u.GetScheme() == "https" {
+		// request URL has the IP chosen by upstream. handshake with its hostname
+		transport.DialTLSContext = u.TLSDialer(dial, nil, transport.TLSHandshakeTimeout)
+	}
+	return lifetime.WrapTransport(transport)
 }
 
 func printVersion() {
@@ -124,7 +181,42 @@ func _main() int {
 	}
 
 	logger, _ := zap.NewProduction()
-	upstream, err := upstream.New(opts.Upstream, logger)
+	routerConfig := &router.Config{}
+	if opts.Config != "" {
+		routerConfig, err = router.LoadConfig(opts.Config)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, uc := range routerConfig.Upstreams {
+		if uc.Zone != nil && uc.Zone.Local == "" {
+			uc.Zone.Local = opts.Zone
+		}
+	}
+	if opts.BackupUpstream != "" && opts.Upstream == "" {
+		log.Fatal("--backup-upstream requires --upstream")
+	}
+	if opts.Upstream != "" {
+		// --upstream is a catch-all route
+		uc := upstream.Config{
+			Name:        defaultUpstreamName,
+			URL:         opts.Upstream,
+			StripPrefix: opts.StripPrefix,
+		}
+		if opts.BackupUpstream != "" {
+			uc.Backup = backupUpstreamName
+			routerConfig.Upstreams = append(routerConfig.Upstreams, upstream.Config{
+				Name:        backupUpstreamName,
+				URL:         opts.BackupUpstream,
+				StripPrefix: opts.StripPrefix,
+			})
+		}
+		routerConfig.Upstreams = append(routerConfig.Upstreams, uc)
+		routerConfig.Routes = append(routerConfig.Routes, router.Route{
+			Upstream: defaultUpstreamName,
+		})
+	}
+	router, err := router.New(routerConfig, logger)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -136,14 +228,45 @@ func _main() int {
 		}
 	}
 
-	transport := makeTransport(opts.KeepaliveConns, opts.MaxConnsPerHost, opts.ProxyReadTimeout)
-	var handler http.Handler = proxy.New(&transport, version, upstream, logger)
+	lifetime := keepalive.Config{
+		MaxAge:        opts.MaxConnAge,
+		JitterPercent: opts.MaxConnAgeJitter,
+		MaxRequests:   opts.MaxConnRequests,
+	}
+	if err := lifetime.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	transport := makeTransport(opts.KeepaliveConns, opts.MaxConnsPerHost, opts.ProxyReadTimeout, lifetime, nil)
+	upstreamTransports := make(map[string]http.RoundTripper)
+	for _, u := range router.Upstreams() {
+		upstreamTransports[u.Name()] = makeTransport(opts.KeepaliveConns, opts.MaxConnsPerHost, opts.ProxyReadTimeout, lifetime, u)
+	}
+	var breakers *breaker.Group
+	if opts.BreakerFailures > 0 {
+		breakers = breaker.NewGroup(breaker.Config{
+			FailureThreshold: opts.BreakerFailures,
+			OpenDuration:     opts.BreakerOpenDuration,
+			HalfOpenRequests: opts.BreakerHalfOpenRequests,
+		}, func(key string, from, to breaker.State) {
+			fields := []zap.Field{
+				zap.String("destination", key),
+				zap.String("from", from.String()),
+				zap.String("to", to.String()),
+			}
+			if to == breaker.Open {
+				logger.Warn("circuit breaker state changed", fields...)
+				return
+			}
+			logger.Info("circuit breaker state changed", fields...)
+		})
+	}
+	var handler http.Handler = proxy.New(&transport, upstreamTransports, version, router, breakers, logger)
 
 	statsChocon, err := statsHTTP.NewCapa(opts.StatsBufsize, opts.StatsSpfactor)
 	if err != nil {
 		log.Fatal(err)
 	}
-	handler = addStatsHandler(handler, statsChocon)
+	handler = addStatsHandler(handler, statsChocon, router, breakers)
 	handler = wrapLogHandler(handler, opts.LogDir, opts.LogRotate, opts.LogRotateTime, logger)
 	handler = wrapStatsHandler(handler, statsChocon)
 
@@ -0,0 +1,133 @@
+package keepalive
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Config : lifetime of keep-alive connections
+type Config struct {
+	// connections older than this are closed after their next request. 0 disables
+	MaxAge time.Duration
+	// max age is shortened randomly by up to this percentage, so that
+	// connections made at once do not expire at once
+	JitterPercent int
+	// connections are closed after this number of requests. 0 disables
+	MaxRequests int64
+}
+
+// Enabled : any limit is set
+func (c Config) Enabled() bool {
+	return c.MaxAge > 0 || c.MaxRequests > 0
+}
+
+// Validate : check jitter is a percentage
+func (c Config) Validate() error {
+	if c.JitterPercent < 0 || c.JitterPercent > 100 {
+		return errors.Errorf("max age jitter should be between 0 and 100: %d", c.JitterPercent)
+	}
+	return nil
+}
+
+// DialFunc : DialContext of http.Transport
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// conn : connection with its expiry and request count
+type conn struct {
+	net.Conn
+	expires  time.Time
+	requests atomic.Int64
+}
+
+// NetConn : underlying connection
+func (c *conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// WrapDial : record creation of connections made by dial
+func (c Config) WrapDial(dial DialFunc) DialFunc {
+	if !c.Enabled() {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		nc, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		lc := &conn{Conn: nc}
+		if c.MaxAge > 0 {
+			age := c.MaxAge
+			if jitter := int64(c.MaxAge) * int64(c.JitterPercent) / 100; jitter > 0 {
+				age -= time.Duration(rand.Int63n(jitter))
+			}
+			lc.expires = time.Now().Add(age)
+		}
+		return lc, nil
+	}
+}
+
+// roundTripper : send "Connection: close" on the last request of a connection
+type roundTripper struct {
+	cfg       Config
+	transport http.RoundTripper
+}
+
+// WrapTransport : retire connections made by WrapDial over max age or max requests.
+// transport should dial with WrapDial
+func (c Config) WrapTransport(transport http.RoundTripper) http.RoundTripper {
+	if !c.Enabled() {
+		return transport
+	}
+	return &roundTripper{cfg: c, transport: transport}
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var r *http.Request
+	trace := &httptrace.ClientTrace{
+		// called before the request is written
+		GotConn: func(info httptrace.GotConnInfo) {
+			lc := find(info.Conn)
+			if lc == nil {
+				return
+			}
+			n := lc.requests.Add(1)
+			if (rt.cfg.MaxRequests > 0 && n >= rt.cfg.MaxRequests) ||
+				(!lc.expires.IsZero() && time.Now().After(lc.expires)) {
+				r.Header.Set("Connection", "close")
+			}
+		},
+	}
+	r = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	// header is shared with the request copied by http.Transport.
+	// clone it not to add Connection header to req
+	r.Header = req.Header.Clone()
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	return rt.transport.RoundTrip(r)
+}
+
+// find : conn under TLS and other wrappers
+func find(nc net.Conn) *conn {
+	for nc != nil {
+		switch c := nc.(type) {
+		case *conn:
+			return c
+		case *tls.Conn:
+			nc = c.NetConn()
+		case interface{ NetConn() net.Conn }:
+			nc = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
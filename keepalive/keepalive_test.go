@@ -0,0 +1,87 @@
+package keepalive
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCountServer(t *testing.T) (*httptest.Server, func() int) {
+	var mu sync.Mutex
+	addrs := map[string]struct{}{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		addrs[r.RemoteAddr] = struct{}{}
+		mu.Unlock()
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(ts.Close)
+	return ts, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(addrs)
+	}
+}
+
+func newClient(cfg Config) *http.Client {
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		DialContext: cfg.WrapDial(dialer.DialContext),
+	}
+	return &http.Client{Transport: cfg.WrapTransport(transport)}
+}
+
+func get(t *testing.T, client *http.Client, url string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	assert.Empty(t, req.Header.Get("Connection"))
+}
+
+func TestMaxRequests(t *testing.T) {
+	ts, conns := newCountServer(t)
+	client := newClient(Config{MaxRequests: 2})
+	for i := 0; i < 5; i++ {
+		get(t, client, ts.URL)
+	}
+	assert.Equal(t, 3, conns())
+}
+
+func TestMaxAge(t *testing.T) {
+	ts, conns := newCountServer(t)
+	client := newClient(Config{MaxAge: 50 * time.Millisecond, JitterPercent: 10})
+	get(t, client, ts.URL)
+	get(t, client, ts.URL)
+	assert.Equal(t, 1, conns())
+
+	time.Sleep(60 * time.Millisecond)
+	// expired connection serves one more request, then is closed
+	get(t, client, ts.URL)
+	assert.Equal(t, 1, conns())
+	get(t, client, ts.URL)
+	assert.Equal(t, 2, conns())
+}
+
+func TestDisabled(t *testing.T) {
+	cfg := Config{JitterPercent: 10}
+	assert.False(t, cfg.Enabled())
+	transport := &http.Transport{}
+	assert.Equal(t, http.RoundTripper(transport), cfg.WrapTransport(transport))
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Config{MaxAge: time.Minute}.Validate())
+	assert.NoError(t, Config{MaxAge: time.Minute, JitterPercent: 100}.Validate())
+	assert.Error(t, Config{MaxAge: time.Minute, JitterPercent: 101}.Validate())
+	assert.Error(t, Config{MaxAge: time.Minute, JitterPercent: -1}.Validate())
+}
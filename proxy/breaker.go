@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/kazeburo/chocon/breaker"
+)
+
+// destinationKey : host:port of ccnproxy destination
+func destinationKey(pr *http.Request) string {
+	if pr.URL.Port() != "" {
+		return pr.URL.Host
+	}
+	if pr.URL.Scheme == "https" {
+		return net.JoinHostPort(pr.URL.Hostname(), "443")
+	}
+	return net.JoinHostPort(pr.URL.Hostname(), "80")
+}
+
+// outcome : dial errors and timeouts are failures of destination
+func outcome(err error) breaker.Outcome {
+	if err == nil {
+		return breaker.Success
+	}
+	if _, ok := err.(net.Error); ok {
+		return breaker.Failure
+	}
+	return breaker.Ignored
+}
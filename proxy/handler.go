@@ -9,9 +9,12 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 
+	"github.com/kazeburo/chocon/breaker"
+	"github.com/kazeburo/chocon/router"
 	"github.com/kazeburo/chocon/upstream"
 	"github.com/rs/xid"
 	"go.uber.org/zap"
@@ -20,6 +23,7 @@ import (
 const (
 	proxyVerHeader                = "X-Chocon-Ver"
 	proxyIDHeader                 = "X-Chocon-Id"
+	circuitHeader                 = "X-Chocon-Circuit"
 	httpStatusClientClosedRequest = 499
 )
 
@@ -44,8 +48,12 @@ type Status struct {
 type Proxy struct {
 	Version   string
 	Transport http.RoundTripper
-	upstream  *upstream.Upstream
-	logger    *zap.Logger
+	// Transport by upstream name
+	upstreamTransports map[string]http.RoundTripper
+	router             *router.Router
+	// circuit breakers of ccnproxy destinations. nil if disabled
+	breakers *breaker.Group
+	logger   *zap.Logger
 }
 
 var pool = sync.Pool{
@@ -53,12 +61,14 @@ var pool = sync.Pool{
 }
 
 // New :  Create a request-based reverse-proxy.
-func New(transport *http.RoundTripper, version string, upstream *upstream.Upstream, logger *zap.Logger) *Proxy {
+func New(transport *http.RoundTripper, upstreamTransports map[string]http.RoundTripper, version string, router *router.Router, breakers *breaker.Group, logger *zap.Logger) *Proxy {
 	return &Proxy{
-		Version:   version,
-		Transport: *transport,
-		upstream:  upstream,
-		logger:    logger,
+		Version:            version,
+		Transport:          *transport,
+		upstreamTransports: upstreamTransports,
+		router:             router,
+		breakers:           breakers,
+		logger:             logger,
 	}
 }
 
@@ -80,15 +90,18 @@ func (proxy *Proxy) ServeHTTP(writer http.ResponseWriter, originalRequest *http.
 	proxyRequest := proxy.copyRequest(originalRequest)
 	status := &Status{Code: http.StatusOK}
 
-	if proxy.upstream.Enabled() {
-		h, ipwc, err := proxy.upstream.Get()
-		defer proxy.upstream.Release(ipwc)
-		if err != nil {
-			status.Code = http.StatusBadGateway
-		}
-		proxyRequest.URL.Scheme = proxy.upstream.GetScheme()
-		proxyRequest.URL.Host = h
+	up, split := proxy.router.Route(originalRequest)
+	if split != nil {
+		sw := &statusWriter{ResponseWriter: writer, status: http.StatusOK}
+		writer = sw
+		defer func() { split.Record(sw.status) }()
+	}
+	if up != nil {
+		// backup pool while the matched pool has no usable IPs
+		up = up.Select()
+		proxyRequest.URL.Scheme = up.GetScheme()
 		proxyRequest.Host = originalRequest.Host
+		up.RewriteURL(proxyRequest.URL)
 	} else {
 		// Set Proxied
 		originalRequest.Header.Set(proxyVerHeader, proxy.Version)
@@ -101,7 +114,44 @@ func (proxy *Proxy) ServeHTTP(writer http.ResponseWriter, originalRequest *http.
 	}
 
 	// Convert a request into a response by using its Transport.
-	response, err := proxy.Transport.RoundTrip(proxyRequest)
+	var response *http.Response
+	var ipwc *upstream.IPwc
+	var err error
+	if up != nil {
+		response, ipwc, err = proxy.upstreamRoundTrip(up, originalRequest, proxyRequest)
+		if ipwc != nil {
+			defer up.Release(ipwc)
+		}
+		if err == errNoUpstreamHost {
+			writer.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if err == upstream.ErrCircuitOpen {
+			writer.Header().Set(circuitHeader, "open")
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if err == upstream.ErrQueueFull || err == upstream.ErrQueueTimeout {
+			writer.Header().Set("Retry-After", strconv.Itoa(up.RetryAfter()))
+			http.Error(writer, "Upstream Busy", http.StatusServiceUnavailable)
+			return
+		}
+		if err == errCanceledInQueue {
+			http.Error(writer, "Client Closed Request", httpStatusClientClosedRequest)
+			return
+		}
+	} else if proxy.breakers != nil {
+		done, ok := proxy.breakers.Allow(destinationKey(proxyRequest))
+		if !ok {
+			writer.Header().Set(circuitHeader, "open")
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		response, err = proxy.Transport.RoundTrip(proxyRequest)
+		done(outcome(err))
+	} else {
+		response, err = proxy.Transport.RoundTrip(proxyRequest)
+	}
 	if err != nil {
 		logger := proxy.logger.With(
 			zap.String("request_host", originalRequest.Host),
@@ -146,6 +196,11 @@ func (proxy *Proxy) ServeHTTP(writer http.ResponseWriter, originalRequest *http.
 		writer.Header()[k] = sv[:n:n]
 		sv = sv[n:]
 	}
+	if up != nil {
+		if c := up.AffinityCookie(ipwc); c != nil {
+			http.SetCookie(writer, c)
+		}
+	}
 
 	// Copy a status code.
 	writer.WriteHeader(response.StatusCode)
@@ -159,11 +214,10 @@ func (proxy *Proxy) rewriteProxyHost(r *http.Request, pr *http.Request, ps *Stat
 		ps.Code = http.StatusBadRequest
 		return
 	}
-	hostPortSplit := strings.Split(r.Host, ":")
-	host := hostPortSplit[0]
-	port := ""
-	if len(hostPortSplit) > 1 {
-		port = ":" + hostPortSplit[1]
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// no port
+		host, port = r.Host, ""
 	}
 	hostSplit := strings.Split(host, ".")
 	lastPartIndex := 0
@@ -177,13 +231,32 @@ func (proxy *Proxy) rewriteProxyHost(r *http.Request, pr *http.Request, ps *Stat
 		return
 	}
 
-	pr.URL.Host = strings.Join(hostSplit[0:lastPartIndex], ".") + port
+	pr.URL.Host = strings.Join(hostSplit[0:lastPartIndex], ".")
+	if port != "" {
+		pr.URL.Host = net.JoinHostPort(pr.URL.Host, port)
+	}
 	pr.Host = pr.URL.Host
 	if hostSplit[lastPartIndex] == "ccnproxy-https" || hostSplit[lastPartIndex] == "ccnproxy-secure" || hostSplit[lastPartIndex] == "ccnproxy-ssl" {
 		pr.URL.Scheme = "https"
 	}
 }
 
+// statusWriter : remember status code written
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap : for http.ResponseController
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
 // Create a new proxy request with some modifications from an original request.
 func (proxy *Proxy) copyRequest(originalRequest *http.Request) *http.Request {
 	proxyRequest := new(http.Request)
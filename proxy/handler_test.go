@@ -1,13 +1,23 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/kazeburo/chocon/breaker"
+	"github.com/kazeburo/chocon/router"
+	"github.com/kazeburo/chocon/upstream"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 var (
@@ -124,3 +134,182 @@ func TestRewriteHost(t *testing.T) {
 		})
 	}
 }
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestDestinationBreaker(t *testing.T) {
+	rt, err := router.New(&router.Config{}, zap.NewNop())
+	assert.NoError(t, err)
+	var calls int
+	var transport http.RoundTripper = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		assert.Equal(t, "api.example.com", r.URL.Host)
+		return nil, timeoutError{}
+	})
+	breakers := breaker.NewGroup(breaker.Config{FailureThreshold: 2}, nil)
+	p := New(&transport, nil, "test", rt, breakers, zap.NewNop())
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com.ccnproxy/", nil))
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com.ccnproxy/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "open", w.Header().Get(circuitHeader))
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, "open", breakers.Stats()["api.example.com:80"].State)
+}
+
+func TestUpstreamBreaker(t *testing.T) {
+	rt, err := router.New(&router.Config{
+		Upstreams: []upstream.Config{{
+			Name:           "api",
+			URL:            "http://127.0.0.1:8080/",
+			CircuitBreaker: &breaker.Config{FailureThreshold: 1, OpenDuration: time.Hour},
+		}},
+		Routes: []router.Route{{Upstream: "api"}},
+	}, zap.NewNop())
+	assert.NoError(t, err)
+	var calls int
+	var transport http.RoundTripper = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		return nil, timeoutError{}
+	})
+	p := New(&transport, nil, "test", rt, nil, zap.NewNop())
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com/", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "open", w.Header().Get(circuitHeader))
+	assert.Equal(t, 1, calls)
+}
+
+func TestUpstreamQueueFull(t *testing.T) {
+	rt, err := router.New(&router.Config{
+		Upstreams: []upstream.Config{{
+			Name:        "api",
+			URL:         "http://127.0.0.1:8080/",
+			Concurrency: &upstream.ConcurrencyConfig{MaxRequests: 1, RetryAfter: 3 * time.Second},
+		}},
+		Routes: []router.Route{{Upstream: "api"}},
+	}, zap.NewNop())
+	assert.NoError(t, err)
+	sent := make(chan struct{})
+	unblock := make(chan struct{})
+	var transport http.RoundTripper = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		close(sent)
+		<-unblock
+		return nil, timeoutError{}
+	})
+	p := New(&transport, nil, "test", rt, nil, zap.NewNop())
+
+	done := make(chan struct{})
+	go func() {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://api.example.com/", nil))
+		close(done)
+	}()
+	<-sent
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "3", w.Header().Get("Retry-After"))
+	close(unblock)
+	<-done
+}
+
+func TestUpstreamCanceledRelease(t *testing.T) {
+	rt, err := router.New(&router.Config{
+		Upstreams: []upstream.Config{{
+			Name:        "api",
+			URL:         "http://127.0.0.1:8080/",
+			Concurrency: &upstream.ConcurrencyConfig{MaxRequests: 1},
+		}},
+		Routes: []router.Route{{Upstream: "api"}},
+	}, zap.NewNop())
+	assert.NoError(t, err)
+	var calls int
+	var transport http.RoundTripper = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		if calls == 1 {
+			return nil, context.Canceled
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+	})
+	core, logs := observer.New(zap.ErrorLevel)
+	p := New(&transport, nil, "test", rt, nil, zap.New(core))
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com/", nil))
+	assert.Equal(t, httpStatusClientClosedRequest, w.Code)
+	assert.Equal(t, 1, logs.FilterMessage("ErrorFromProxy").Len())
+	// the slot of the canceled request is released
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 2, calls)
+}
+
+func TestUpstreamQueueCanceled(t *testing.T) {
+	rt, err := router.New(&router.Config{
+		Upstreams: []upstream.Config{{
+			Name:        "api",
+			URL:         "http://127.0.0.1:8080/",
+			Concurrency: &upstream.ConcurrencyConfig{MaxRequests: 1, MaxQueue: 2, QueueTimeout: time.Hour, RetryAfter: 3 * time.Second},
+		}},
+		Routes: []router.Route{{Upstream: "api"}},
+	}, zap.NewNop())
+	assert.NoError(t, err)
+	sent := make(chan struct{})
+	unblock := make(chan struct{})
+	var transport http.RoundTripper = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		close(sent)
+		<-unblock
+		return nil, timeoutError{}
+	})
+	p := New(&transport, nil, "test", rt, nil, zap.NewNop())
+
+	done := make(chan struct{})
+	go func() {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://api.example.com/", nil))
+		close(done)
+	}()
+	<-sent
+
+	// deadline of the request passes in queue
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com/", nil).WithContext(ctx))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "3", w.Header().Get("Retry-After"))
+
+	// client closes request in queue
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com/", nil).WithContext(ctx))
+	assert.Equal(t, httpStatusClientClosedRequest, w.Code)
+
+	close(unblock)
+	<-done
+}
+
+func TestDestinationKey(t *testing.T) {
+	for _, c := range []struct{ scheme, host, key string }{
+		{"http", "api.example.com", "api.example.com:80"},
+		{"https", "api.example.com", "api.example.com:443"},
+		{"http", "api.example.com:8080", "api.example.com:8080"},
+		{"http", "[2001:db8::1]", "[2001:db8::1]:80"},
+		{"https", "[2001:db8::1]:8443", "[2001:db8::1]:8443"},
+	} {
+		pr := &http.Request{URL: &url.URL{Scheme: c.scheme, Host: c.host}}
+		assert.Equal(t, c.key, destinationKey(pr))
+	}
+}
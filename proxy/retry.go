@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kazeburo/chocon/breaker"
+	"github.com/kazeburo/chocon/upstream"
+	"go.uber.org/zap"
+)
+
+var errNoUpstreamHost = errors.New("no upstream host")
+
+// errCanceledInQueue : client closed request before it was sent upstream
+var errCanceledInQueue = errors.New("client closed request waiting for upstream")
+
+// fallbackBodySize : request body up to this size is buffered to fall back
+// to the other address family when upstream has no retry policy
+const fallbackBodySize = 64 * 1024
+
+var idempotentMethods = map[string]struct{}{
+	"GET":     struct{}{},
+	"HEAD":    struct{}{},
+	"OPTIONS": struct{}{},
+	"TRACE":   struct{}{},
+	"PUT":     struct{}{},
+	"DELETE":  struct{}{},
+}
+
+// upstreamRoundTrip : send request to an IP chosen by upstream, retrying on
+// another IP by upstream's retry policy. returned IPwc must be released
+func (proxy *Proxy) upstreamRoundTrip(up *upstream.Upstream, originalRequest, proxyRequest *http.Request) (*http.Response, *upstream.IPwc, error) {
+	transport := proxy.Transport
+	if t, ok := proxy.upstreamTransports[up.Name()]; ok {
+		transport = t
+	}
+
+	h, ipwc, err := up.Get(originalRequest)
+	if err != nil {
+		up.Release(ipwc)
+		switch err {
+		case upstream.ErrCircuitOpen, upstream.ErrQueueFull, upstream.ErrQueueTimeout:
+			return nil, nil, err
+		case context.DeadlineExceeded:
+			// deadline of the request passed while waiting in queue
+			return nil, nil, upstream.ErrQueueTimeout
+		case context.Canceled:
+			return nil, nil, errCanceledInQueue
+		}
+		return nil, nil, errNoUpstreamHost
+	}
+
+	policy := up.Retry()
+	eyeballs := up.HappyEyeballs()
+	if policy == nil && !eyeballs {
+		proxyRequest.URL.Host = h
+		res, err := transport.RoundTrip(proxyRequest)
+		report(up, ipwc, err)
+		return res, ipwc, err
+	}
+	if policy == nil {
+		// fall back to the other address family without retries
+		policy = &upstream.RetryConfig{MaxBodySize: fallbackBodySize}
+	}
+
+	replayable := prepareReplay(proxyRequest, policy.MaxBodySize)
+	fallback := eyeballs && replayable
+	start := time.Now()
+	var tried []*upstream.IPwc
+	for attempt := 0; ; attempt++ {
+		// proxyRequest itself is not sent, so that it can be updated after
+		// an attempt still writing the request was abandoned
+		req := attemptRequest(proxyRequest, h)
+		if fallback {
+			req = req.WithContext(upstream.WithFallback(req.Context()))
+		}
+		res, err := transport.RoundTrip(req)
+		if !errors.Is(err, upstream.ErrFallbackDelay) {
+			// an IP given up on at happy eyeballs delay has not failed
+			report(up, ipwc, err)
+		}
+		proxyRequest.URL.Host = h
+
+		if fallback && err != nil && isConnectError(err) && req.Context().Err() == nil {
+			// the IP did not connect in time. send the request to an IP of
+			// the other family once. it is not counted as a retry
+			fallback = false
+			nh, nipwc, gerr := up.Fallback(originalRequest, ipwc)
+			if gerr == nil {
+				proxy.logger.Warn("FallbackProxy",
+					zap.String("upstream", up.Name()),
+					zap.String("proxy_host", h),
+					zap.String("fallback_host", nh),
+					zap.String("proxy_id", originalRequest.Header.Get(proxyIDHeader)),
+					zap.Error(err),
+				)
+				tried = append(tried, ipwc)
+				up.Release(ipwc)
+				h, ipwc = nh, nipwc
+				attempt--
+				continue
+			}
+			up.Release(nipwc)
+		}
+
+		if attempt >= policy.Attempts ||
+			(policy.Budget > 0 && time.Since(start) >= policy.Budget) ||
+			!shouldRetry(policy, req, res, err, replayable) {
+			return res, ipwc, err
+		}
+		tried = append(tried, ipwc)
+		nh, nipwc, gerr := up.Get(originalRequest, tried...)
+		if gerr != nil {
+			// no other IP to retry
+			up.Release(nipwc)
+			return res, ipwc, err
+		}
+
+		fields := []zap.Field{
+			zap.String("upstream", up.Name()),
+			zap.String("proxy_host", h),
+			zap.String("retry_host", nh),
+			zap.Int("attempt", attempt+1),
+			zap.String("proxy_id", originalRequest.Header.Get(proxyIDHeader)),
+		}
+		if err != nil {
+			fields = append(fields, zap.Error(err))
+		} else {
+			fields = append(fields, zap.Int("status", res.StatusCode))
+			io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+			res.Body.Close()
+		}
+		proxy.logger.Warn("RetryProxy", fields...)
+		up.Release(ipwc)
+		h, ipwc = nh, nipwc
+	}
+}
+
+// report : feed result of proxied request back to upstream
+func report(up *upstream.Upstream, ipwc *upstream.IPwc, err error) {
+	switch outcome(err) {
+	case breaker.Success:
+		up.Report(ipwc, nil)
+	case breaker.Failure:
+		up.Report(ipwc, err)
+	}
+}
+
+func shouldRetry(policy *upstream.RetryConfig, req *http.Request, res *http.Response, err error, replayable bool) bool {
+	if !replayable || req.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		if isConnectError(err) {
+			// request has not reached upstream
+			return policy.OnConnectError()
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return policy.OnTimeout() && isIdempotent(req)
+		}
+		return false
+	}
+	return policy.OnStatus(res.StatusCode) && isIdempotent(req)
+}
+
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isIdempotent(req *http.Request) bool {
+	if _, ok := idempotentMethods[req.Method]; ok {
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+// prepareReplay : buffer request body up to max to send it again.
+// returns false if the body cannot be replayed
+func prepareReplay(req *http.Request, max int64) bool {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return true
+	}
+	if req.ContentLength < 0 || req.ContentLength > max {
+		return false
+	}
+	b, err := io.ReadAll(io.LimitReader(req.Body, req.ContentLength))
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return false
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	return true
+}
+
+// attemptRequest : copy of proxy request sent to host
+func attemptRequest(pr *http.Request, host string) *http.Request {
+	req := new(http.Request)
+	u := new(url.URL)
+	*req = *pr
+	*u = *pr.URL
+	u.Host = host
+	req.URL = u
+	if pr.GetBody != nil {
+		req.Body, _ = pr.GetBody()
+	}
+	return req
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kazeburo/chocon/breaker"
+	"github.com/kazeburo/chocon/upstream"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout awaiting response headers" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func testRetryPolicy(t *testing.T, src string) *upstream.RetryConfig {
+	cfg := upstream.Config{}
+	assert.NoError(t, yaml.Unmarshal([]byte(src), &cfg))
+	u, err := upstream.New(cfg, zap.NewNop())
+	assert.NoError(t, err)
+	return u.Retry()
+}
+
+func TestShouldRetry(t *testing.T) {
+	policy := testRetryPolicy(t, `
+retry:
+  attempts: 2
+  on: [connect_error, timeout]
+  status: [502, 503]
+`)
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: io.EOF}
+	get, _ := http.NewRequest("GET", "http://192.0.2.1/", nil)
+	post, _ := http.NewRequest("POST", "http://192.0.2.1/", strings.NewReader("x"))
+
+	assert.True(t, shouldRetry(policy, get, nil, dialErr, true))
+	assert.True(t, shouldRetry(policy, post, nil, dialErr, true))
+	assert.False(t, shouldRetry(policy, post, nil, dialErr, false))
+
+	assert.True(t, shouldRetry(policy, get, nil, timeoutError{}, true))
+	assert.False(t, shouldRetry(policy, post, nil, timeoutError{}, true))
+	post.Header.Set("Idempotency-Key", "abc")
+	assert.True(t, shouldRetry(policy, post, nil, timeoutError{}, true))
+
+	assert.True(t, shouldRetry(policy, get, &http.Response{StatusCode: 503}, nil, true))
+	assert.False(t, shouldRetry(policy, get, &http.Response{StatusCode: 500}, nil, true))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, shouldRetry(policy, get.WithContext(ctx), nil, dialErr, true))
+
+	// default: connect_error only
+	policy = testRetryPolicy(t, `
+retry:
+  attempts: 1
+`)
+	assert.True(t, shouldRetry(policy, get, nil, dialErr, true))
+	assert.False(t, shouldRetry(policy, get, nil, timeoutError{}, true))
+}
+
+func TestPrepareReplay(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "/", nil)
+	req.Body = io.NopCloser(bytes.NewReader([]byte("hello")))
+	req.ContentLength = 5
+	assert.True(t, prepareReplay(req, 1024))
+	for i := 0; i < 2; i++ {
+		r := attemptRequest(req, "192.0.2.1:80")
+		b, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "hello", string(b))
+		assert.Equal(t, "192.0.2.1:80", r.URL.Host)
+	}
+
+	req, _ = http.NewRequest("PUT", "/", nil)
+	req.Body = io.NopCloser(bytes.NewReader([]byte("hello")))
+	req.ContentLength = 5
+	assert.False(t, prepareReplay(req, 4))
+
+	req, _ = http.NewRequest("PUT", "/", nil)
+	req.Body = io.NopCloser(bytes.NewReader([]byte("hello")))
+	req.ContentLength = -1
+	assert.False(t, prepareReplay(req, 1024))
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	assert.True(t, prepareReplay(req, 1024))
+}
+
+func TestFallback(t *testing.T) {
+	up, err := upstream.New(upstream.Config{
+		URL:            "http://dual.internal/",
+		Members:        []upstream.MemberConfig{{Host: "192.0.2.1:80"}, {Host: "[2001:db8::1]:80"}},
+		AddressFamily:  "prefer_ipv4",
+		CircuitBreaker: &breaker.Config{FailureThreshold: 2, OpenDuration: time.Hour},
+	}, zap.NewNop())
+	assert.NoError(t, err)
+	var hosts []string
+	var transport http.RoundTripper = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		hosts = append(hosts, r.URL.Host)
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "hello", string(body))
+		if r.URL.Host == "192.0.2.1:80" {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: io.EOF}
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	p := New(&transport, nil, "test", nil, nil, zap.NewNop())
+
+	req, _ := http.NewRequest("POST", "http://dual.internal/", strings.NewReader("hello"))
+	res, ipwc, err := p.upstreamRoundTrip(up, req, req.Clone(req.Context()))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []string{"192.0.2.1:80", "[2001:db8::1]:80"}, hosts)
+	up.Release(ipwc)
+
+	// the IP which did not connect is reported, not the fallback
+	for _, ip := range up.Status().IPs {
+		if ip.Host == "192.0.2.1:80" {
+			assert.Equal(t, 1, ip.Breaker.Failures)
+		} else {
+			assert.Equal(t, 0, ip.Breaker.Failures)
+		}
+	}
+}
+
+func TestFallbackDelay(t *testing.T) {
+	up, err := upstream.New(upstream.Config{
+		URL: "http://dual.internal/",
+		Members: []upstream.MemberConfig{
+			{Host: "192.0.2.1:80"}, {Host: "[2001:db8::1]:80"}, {Host: "[2001:db8::2]:80"},
+		},
+		AddressFamily:  "prefer_ipv4",
+		CircuitBreaker: &breaker.Config{FailureThreshold: 1, OpenDuration: time.Hour},
+		Retry:          &upstream.RetryConfig{Attempts: 2, Status: []int{503}},
+	}, zap.NewNop())
+	assert.NoError(t, err)
+	var hosts []string
+	var transport http.RoundTripper = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		hosts = append(hosts, r.URL.Host)
+		if r.URL.Host == "192.0.2.1:80" {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: upstream.ErrFallbackDelay}
+		}
+		if len(hosts) == 2 {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	p := New(&transport, nil, "test", nil, nil, zap.NewNop())
+
+	req, _ := http.NewRequest("GET", "http://dual.internal/", nil)
+	res, ipwc, err := p.upstreamRoundTrip(up, req, req.Clone(req.Context()))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	up.Release(ipwc)
+	// the retry does not go back to the IP given up on
+	assert.Len(t, hosts, 3)
+	assert.Equal(t, "192.0.2.1:80", hosts[0])
+	assert.NotEqual(t, "192.0.2.1:80", hosts[2])
+	assert.NotEqual(t, hosts[1], hosts[2])
+
+	// the IP given up on is not reported as failed
+	for _, ip := range up.Status().IPs {
+		if ip.Host == "192.0.2.1:80" {
+			assert.Equal(t, 0, ip.Breaker.Failures)
+			assert.Equal(t, "closed", ip.Breaker.State)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// minimal DNS message encoder and decoder (RFC 1035, RFC 2782)
+
+const (
+	typeA     uint16 = 1
+	typeCNAME uint16 = 5
+	typeAAAA  uint16 = 28
+	typeSRV   uint16 = 33
+	classINET uint16 = 1
+
+	headerLen = 12
+
+	flagResponse  = 1 << 15
+	flagTruncated = 1 << 9
+	flagRecursion = 1 << 8
+
+	rcodeSuccess  = 0
+	rcodeNXDomain = 3
+)
+
+var errNotFound = errors.New("no such host")
+
+type record struct {
+	rtype uint16
+	ttl   uint32
+	ip    net.IP
+	srv   *net.SRV
+}
+
+type response struct {
+	truncated bool
+	rcode     int
+	answers   []record
+}
+
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return append(b, 0), nil
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.Errorf("invalid name: %s", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+func buildQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	b := make([]byte, headerLen, 512)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], flagRecursion)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	b, err := appendName(b, name)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	b = binary.BigEndian.AppendUint16(b, classINET)
+	return b, nil
+}
+
+// readName : read possibly compressed name at off. returns name and offset after it
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; hops < 64; hops++ {
+		if off >= len(msg) {
+			return "", 0, errors.New("name overflows message")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("pointer overflows message")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errors.New("label overflows message")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+	return "", 0, errors.New("too many compression pointers")
+}
+
+func parseResponse(id uint16, msg []byte) (*response, error) {
+	if len(msg) < headerLen {
+		return nil, errors.New("short message")
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, errors.New("id mismatch")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&flagResponse == 0 {
+		return nil, errors.New("not a response")
+	}
+	res := &response{
+		truncated: flags&flagTruncated != 0,
+		rcode:     int(flags & 0x0f),
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := headerLen
+	for i := 0; i < qdcount; i++ {
+		_, n, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n + 4
+	}
+	for i := 0; i < ancount; i++ {
+		_, n, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		if off+10 > len(msg) {
+			return nil, errors.New("record overflows message")
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, errors.New("rdata overflows message")
+		}
+		rdata := msg[off : off+rdlen]
+		rr := record{rtype: rtype, ttl: ttl}
+		switch rtype {
+		case typeA:
+			if rdlen != net.IPv4len {
+				return nil, errors.New("invalid A record")
+			}
+			rr.ip = net.IP(append([]byte(nil), rdata...))
+		case typeAAAA:
+			if rdlen != net.IPv6len {
+				return nil, errors.New("invalid AAAA record")
+			}
+			rr.ip = net.IP(append([]byte(nil), rdata...))
+		case typeSRV:
+			if rdlen < 7 {
+				return nil, errors.New("invalid SRV record")
+			}
+			target, _, err := readName(msg, off+6)
+			if err != nil {
+				return nil, err
+			}
+			rr.srv = &net.SRV{
+				Priority: binary.BigEndian.Uint16(rdata[0:]),
+				Weight:   binary.BigEndian.Uint16(rdata[2:]),
+				Port:     binary.BigEndian.Uint16(rdata[4:]),
+				Target:   target + ".",
+			}
+		}
+		res.answers = append(res.answers, rr)
+		off += rdlen
+	}
+	return res, nil
+}
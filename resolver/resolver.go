@@ -0,0 +1,265 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultRefresh : refresh interval when TTL is unknown
+const defaultRefresh = 3 * time.Second
+
+// Config : DNS resolver
+type Config struct {
+	// nameservers host:port. system resolver is used if empty
+	Nameservers []string `yaml:"nameservers"`
+	// udp (default) or tcp. udp retries over tcp if the answer is truncated
+	Protocol string `yaml:"protocol"`
+	// timeout of a lookup, shared among nameservers. default 10s
+	Timeout time.Duration `yaml:"timeout"`
+	// refresh interval is TTL of answers clamped to min_refresh and max_refresh.
+	// default 1s and 30s. 3s is used when TTL is unknown (system resolver)
+	MinRefresh time.Duration `yaml:"min_refresh"`
+	MaxRefresh time.Duration `yaml:"max_refresh"`
+}
+
+// Resolver : DNS resolver aware of TTL
+type Resolver struct {
+	nameservers []string
+	protocol    string
+	timeout     time.Duration
+	minRefresh  time.Duration
+	maxRefresh  time.Duration
+	dialer      net.Dialer
+}
+
+// New :
+func New(cfg Config) (*Resolver, error) {
+	r := &Resolver{
+		protocol:   cfg.Protocol,
+		timeout:    cfg.Timeout,
+		minRefresh: cfg.MinRefresh,
+		maxRefresh: cfg.MaxRefresh,
+	}
+	if r.protocol == "" {
+		r.protocol = "udp"
+	}
+	if r.protocol != "udp" && r.protocol != "tcp" {
+		return nil, errors.Errorf("resolver protocol should be udp or tcp: %s", cfg.Protocol)
+	}
+	if r.timeout <= 0 {
+		r.timeout = 10 * time.Second
+	}
+	if r.minRefresh <= 0 {
+		r.minRefresh = time.Second
+	}
+	if r.maxRefresh <= 0 {
+		r.maxRefresh = 30 * time.Second
+	}
+	if r.maxRefresh < r.minRefresh {
+		return nil, errors.New("resolver max_refresh should not be less than min_refresh")
+	}
+	for _, ns := range cfg.Nameservers {
+		if _, _, err := net.SplitHostPort(ns); err != nil {
+			ns = net.JoinHostPort(ns, "53")
+		}
+		r.nameservers = append(r.nameservers, ns)
+	}
+	return r, nil
+}
+
+// Timeout : timeout of a lookup
+func (r *Resolver) Timeout() time.Duration {
+	return r.timeout
+}
+
+// RefreshInterval : interval until next lookup. ttl 0 means unknown
+func (r *Resolver) RefreshInterval(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = defaultRefresh
+	}
+	if ttl < r.minRefresh {
+		return r.minRefresh
+	}
+	if ttl > r.maxRefresh {
+		return r.maxRefresh
+	}
+	return ttl
+}
+
+// LookupIP : resolve A and AAAA records. returns the lowest TTL of answers
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	if len(r.nameservers) == 0 {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		ips := make([]net.IP, len(addrs))
+		for i, ia := range addrs {
+			ips[i] = ia.IP
+		}
+		return ips, 0, nil
+	}
+
+	var wg sync.WaitGroup
+	var res [2]*response
+	var errs [2]error
+	for i, qtype := range []uint16{typeA, typeAAAA} {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			res[i], errs[i] = r.exchange(ctx, host, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+	if errs[0] != nil && errs[1] != nil {
+		return nil, 0, errs[0]
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for _, rs := range res {
+		if rs == nil {
+			continue
+		}
+		for _, rr := range rs.answers {
+			if rr.ip == nil {
+				continue
+			}
+			ips = append(ips, rr.ip)
+			if ttl == 0 || rr.ttl < ttl {
+				ttl = rr.ttl
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, errors.Wrap(errNotFound, host)
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// LookupSRV : resolve SRV records sorted by priority. returns the lowest TTL of answers
+func (r *Resolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	if len(r.nameservers) == 0 {
+		_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		return srvs, 0, err
+	}
+	res, err := r.exchange(ctx, name, typeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var srvs []*net.SRV
+	var ttl uint32
+	for _, rr := range res.answers {
+		if rr.srv == nil {
+			continue
+		}
+		srvs = append(srvs, rr.srv)
+		if ttl == 0 || rr.ttl < ttl {
+			ttl = rr.ttl
+		}
+	}
+	if len(srvs) == 0 {
+		return nil, 0, errors.Wrap(errNotFound, name)
+	}
+	sort.SliceStable(srvs, func(i, j int) bool {
+		return srvs[i].Priority < srvs[j].Priority
+	})
+	return srvs, time.Duration(ttl) * time.Second, nil
+}
+
+// exchange : query nameservers in order until one answers
+func (r *Resolver) exchange(ctx context.Context, name string, qtype uint16) (*response, error) {
+	var lastErr error
+	for i, ns := range r.nameservers {
+		nsCtx, cancel := r.attemptContext(ctx, len(r.nameservers)-i)
+		res, err := r.exchangeWith(nsCtx, ns, r.protocol, name, qtype)
+		if err == nil && res.truncated && r.protocol == "udp" {
+			res, err = r.exchangeWith(nsCtx, ns, "tcp", name, qtype)
+		}
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch res.rcode {
+		case rcodeSuccess:
+			return res, nil
+		case rcodeNXDomain:
+			return nil, errors.Wrap(errNotFound, name)
+		}
+		lastErr = errors.Errorf("nameserver %s returned rcode %d for %s", ns, res.rcode, name)
+	}
+	return nil, lastErr
+}
+
+// attemptContext : context of a nameserver with an equal share of the time
+// left for remaining nameservers, so that a nameserver never answering does
+// not use up the timeout of the lookup
+func (r *Resolver) attemptContext(ctx context.Context, remaining int) (context.Context, context.CancelFunc) {
+	left := r.timeout
+	if d, ok := ctx.Deadline(); ok {
+		left = time.Until(d)
+	}
+	return context.WithTimeout(ctx, left/time.Duration(remaining))
+}
+
+func (r *Resolver) exchangeWith(ctx context.Context, ns, network, name string, qtype uint16) (*response, error) {
+	id := uint16(rand.Uint32())
+	q, err := buildQuery(id, strings.TrimSuffix(name, ".")+".", qtype)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := r.dialer.DialContext(ctx, network, ns)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(q); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			res, err := parseResponse(id, buf[:n])
+			if err != nil {
+				// ignore stray packet
+				continue
+			}
+			return res, nil
+		}
+	}
+
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, len(q)+2), uint16(len(q)))
+	if _, err := conn.Write(append(msg, q...)); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return parseResponse(id, buf)
+}
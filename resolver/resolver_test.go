@@ -0,0 +1,263 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type stubRR struct {
+	rtype uint16
+	ttl   uint32
+	rdata []byte
+}
+
+// stubServer : in-process DNS server answering from records
+type stubServer struct {
+	records map[string][]stubRR
+	// set TC flag on UDP answers
+	truncate atomic.Bool
+	udp      net.PacketConn
+	tcp      net.Listener
+}
+
+func newStubServer(t *testing.T, records map[string][]stubRR) *stubServer {
+	s := &stubServer{records: records}
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	assert.NoError(t, err)
+	s.udp = udp
+	s.tcp = tcp
+	go s.serveUDP()
+	go s.serveTCP()
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+	return s
+}
+
+func (s *stubServer) addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *stubServer) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.udp.WriteTo(s.answer(buf[:n], s.truncate.Load()), addr)
+	}
+}
+
+func (s *stubServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var l [2]byte
+			if _, err := io.ReadFull(conn, l[:]); err != nil {
+				return
+			}
+			q := make([]byte, binary.BigEndian.Uint16(l[:]))
+			if _, err := io.ReadFull(conn, q); err != nil {
+				return
+			}
+			a := s.answer(q, false)
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(a))), a...))
+		}()
+	}
+}
+
+func (s *stubServer) answer(q []byte, truncate bool) []byte {
+	name, off, _ := readName(q, headerLen)
+	qtype := binary.BigEndian.Uint16(q[off:])
+	question := q[headerLen : off+4]
+
+	rrs, found := s.records[strings.ToLower(name)]
+	flags := uint16(flagResponse | flagRecursion)
+	if !found {
+		flags |= rcodeNXDomain
+	}
+	var answers []stubRR
+	for _, rr := range rrs {
+		if rr.rtype == qtype {
+			answers = append(answers, rr)
+		}
+	}
+	if truncate && len(answers) > 0 {
+		flags |= flagTruncated
+		answers = nil
+	}
+
+	b := make([]byte, headerLen)
+	copy(b, q[:2])
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint16(b[6:], uint16(len(answers)))
+	b = append(b, question...)
+	for _, rr := range answers {
+		// compression pointer to question name
+		b = binary.BigEndian.AppendUint16(b, 0xc000|headerLen)
+		b = binary.BigEndian.AppendUint16(b, rr.rtype)
+		b = binary.BigEndian.AppendUint16(b, classINET)
+		b = binary.BigEndian.AppendUint32(b, rr.ttl)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(rr.rdata)))
+		b = append(b, rr.rdata...)
+	}
+	return b
+}
+
+func aRR(ip string, ttl uint32) stubRR {
+	p := net.ParseIP(ip)
+	if p4 := p.To4(); p4 != nil {
+		return stubRR{rtype: typeA, ttl: ttl, rdata: p4}
+	}
+	return stubRR{rtype: typeAAAA, ttl: ttl, rdata: p.To16()}
+}
+
+func srvRR(priority, weight, port uint16, target string, ttl uint32) stubRR {
+	b := binary.BigEndian.AppendUint16(nil, priority)
+	b = binary.BigEndian.AppendUint16(b, weight)
+	b = binary.BigEndian.AppendUint16(b, port)
+	b, _ = appendName(b, target)
+	return stubRR{rtype: typeSRV, ttl: ttl, rdata: b}
+}
+
+func TestLookupIP(t *testing.T) {
+	s := newStubServer(t, map[string][]stubRR{
+		"api.example.test": {
+			aRR("192.0.2.1", 60),
+			aRR("192.0.2.2", 30),
+			aRR("2001:db8::1", 45),
+		},
+	})
+	r, err := New(Config{Nameservers: []string{s.addr()}, Timeout: time.Second})
+	assert.NoError(t, err)
+
+	ips, ttl, err := r.LookupIP(context.Background(), "api.example.test")
+	assert.NoError(t, err)
+	assert.Len(t, ips, 3)
+	assert.Equal(t, 30*time.Second, ttl)
+	assert.Equal(t, 30*time.Second, r.RefreshInterval(ttl))
+
+	_, _, err = r.LookupIP(context.Background(), "unknown.example.test")
+	assert.Error(t, err)
+
+	// IP literal
+	ips, ttl, err = r.LookupIP(context.Background(), "192.0.2.10")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.10", ips[0].String())
+	assert.Equal(t, time.Duration(0), ttl)
+}
+
+func TestLookupTruncated(t *testing.T) {
+	s := newStubServer(t, map[string][]stubRR{
+		"api.example.test": {aRR("192.0.2.1", 60)},
+	})
+	s.truncate.Store(true)
+	r, err := New(Config{Nameservers: []string{s.addr()}, Timeout: time.Second})
+	assert.NoError(t, err)
+
+	ips, _, err := r.LookupIP(context.Background(), "api.example.test")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, []string{ips[0].String()})
+
+	r, err = New(Config{Nameservers: []string{s.addr()}, Protocol: "tcp", Timeout: time.Second})
+	assert.NoError(t, err)
+	ips, _, err = r.LookupIP(context.Background(), "api.example.test")
+	assert.NoError(t, err)
+	assert.Len(t, ips, 1)
+}
+
+func TestLookupSRV(t *testing.T) {
+	s := newStubServer(t, map[string][]stubRR{
+		"_api._tcp.example.test": {
+			srvRR(20, 10, 8002, "b.example.test", 120),
+			srvRR(10, 5, 8001, "a.example.test", 90),
+		},
+	})
+	r, err := New(Config{Nameservers: []string{s.addr()}, Timeout: time.Second, MaxRefresh: time.Minute})
+	assert.NoError(t, err)
+
+	srvs, ttl, err := r.LookupSRV(context.Background(), "_api._tcp.example.test")
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Second, ttl)
+	assert.Equal(t, time.Minute, r.RefreshInterval(ttl))
+	assert.Equal(t, []net.SRV{
+		{Target: "a.example.test.", Port: 8001, Priority: 10, Weight: 5},
+		{Target: "b.example.test.", Port: 8002, Priority: 20, Weight: 10},
+	}, []net.SRV{*srvs[0], *srvs[1]})
+}
+
+func TestNameserverFailover(t *testing.T) {
+	s := newStubServer(t, map[string][]stubRR{
+		"api.example.test": {aRR("192.0.2.1", 5)},
+	})
+	// nothing listens on the first nameserver
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	r, err := New(Config{Nameservers: []string{deadAddr, s.addr()}, Protocol: "tcp", Timeout: time.Second})
+	assert.NoError(t, err)
+	ips, ttl, err := r.LookupIP(context.Background(), "api.example.test")
+	assert.NoError(t, err)
+	assert.Len(t, ips, 1)
+	assert.Equal(t, 5*time.Second, r.RefreshInterval(ttl))
+}
+
+func TestNameserverSilent(t *testing.T) {
+	s := newStubServer(t, map[string][]stubRR{
+		"api.example.test": {aRR("192.0.2.1", 5)},
+	})
+	// the first nameserver reads queries and never answers
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { silent.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, _, err := silent.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	r, err := New(Config{Nameservers: []string{silent.LocalAddr().String(), s.addr()}, Timeout: time.Second})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout())
+	defer cancel()
+	start := time.Now()
+	ips, _, err := r.LookupIP(ctx, "api.example.test")
+	assert.NoError(t, err)
+	assert.Len(t, ips, 1)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRefreshInterval(t *testing.T) {
+	r, err := New(Config{MinRefresh: 2 * time.Second, MaxRefresh: 10 * time.Second})
+	assert.NoError(t, err)
+	assert.Equal(t, 3*time.Second, r.RefreshInterval(0))
+	assert.Equal(t, 2*time.Second, r.RefreshInterval(time.Second))
+	assert.Equal(t, 10*time.Second, r.RefreshInterval(time.Hour))
+
+	_, err = New(Config{MinRefresh: 2 * time.Second, MaxRefresh: time.Second})
+	assert.Error(t, err)
+	_, err = New(Config{Protocol: "quic"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,186 @@
+package router
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kazeburo/chocon/upstream"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// Route : maps Host header and path prefix to a named upstream
+type Route struct {
+	// Host header to match. empty matches any host
+	Host string `yaml:"host"`
+	// Path prefix to match. empty matches any path
+	Path string `yaml:"path"`
+	// Name of the upstream pool
+	Upstream string `yaml:"upstream"`
+	// split requests among upstream pools by weight instead of upstream
+	Splits  []SplitConfig `yaml:"splits"`
+	SplitBy SplitBy       `yaml:"split_by"`
+}
+
+// Config : upstream pools and routing table
+type Config struct {
+	Upstreams []upstream.Config `yaml:"upstreams"`
+	Routes    []Route           `yaml:"routes"`
+}
+
+// LoadConfig : read config from YAML (or JSON) file
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read config")
+	}
+	cfg := &Config{}
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, errors.Wrap(err, "could not parse config")
+	}
+	return cfg, nil
+}
+
+type route struct {
+	host     string
+	path     string
+	upstream *upstream.Upstream
+	// nil unless requests are split
+	splits  []*Split
+	splitBy SplitBy
+}
+
+// Router : select upstream pool by request
+type Router struct {
+	upstreams []*upstream.Upstream
+	routes    []*route
+}
+
+// New : create upstream pools and routing table
+func New(cfg *Config, logger *zap.Logger) (*Router, error) {
+	byName := make(map[string]*upstream.Upstream, len(cfg.Upstreams))
+	upstreams := make([]*upstream.Upstream, 0, len(cfg.Upstreams))
+	for _, uc := range cfg.Upstreams {
+		if uc.Name == "" {
+			return nil, errors.New("upstream name is required")
+		}
+		if _, ok := byName[uc.Name]; ok {
+			return nil, errors.Errorf("duplicated upstream name: %s", uc.Name)
+		}
+		if uc.URL == "" {
+			return nil, errors.Errorf("upstream %s: url is required", uc.Name)
+		}
+		u, err := upstream.New(uc, logger)
+		if err != nil {
+			return nil, errors.Wrapf(err, "upstream %s", uc.Name)
+		}
+		byName[uc.Name] = u
+		upstreams = append(upstreams, u)
+	}
+
+	for _, uc := range cfg.Upstreams {
+		if uc.Backup == "" {
+			continue
+		}
+		b, ok := byName[uc.Backup]
+		if !ok {
+			return nil, errors.Errorf("upstream %s: unknown backup upstream: %s", uc.Name, uc.Backup)
+		}
+		byName[uc.Name].SetBackup(b)
+	}
+	// a chain of backups must end
+	for _, u := range upstreams {
+		seen := map[*upstream.Upstream]struct{}{}
+		for p := u; p != nil; p = p.Backup() {
+			if _, ok := seen[p]; ok {
+				return nil, errors.Errorf("upstream %s: backup upstreams form a cycle", u.Name())
+			}
+			seen[p] = struct{}{}
+		}
+	}
+
+	routes := make([]*route, 0, len(cfg.Routes))
+	for _, rc := range cfg.Routes {
+		r := &route{
+			host:    strings.ToLower(rc.Host),
+			path:    rc.Path,
+			splitBy: rc.SplitBy,
+		}
+		if len(rc.Splits) > 0 {
+			if rc.Upstream != "" {
+				return nil, errors.New("upstream and splits of route are exclusive")
+			}
+			splits, err := newSplits(rc, byName)
+			if err != nil {
+				return nil, err
+			}
+			r.splits = splits
+		} else {
+			u, ok := byName[rc.Upstream]
+			if !ok {
+				return nil, errors.Errorf("route refers unknown upstream: %s", rc.Upstream)
+			}
+			r.upstream = u
+		}
+		routes = append(routes, r)
+	}
+	// most specific route first: host matched routes, then longer path prefix
+	sort.SliceStable(routes, func(i, j int) bool {
+		if (routes[i].host == "") != (routes[j].host == "") {
+			return routes[i].host != ""
+		}
+		return len(routes[i].path) > len(routes[j].path)
+	})
+
+	return &Router{
+		upstreams: upstreams,
+		routes:    routes,
+	}, nil
+}
+
+// Upstreams : all upstream pools
+func (rt *Router) Upstreams() []*upstream.Upstream {
+	return rt.upstreams
+}
+
+// Route : find upstream for request, and the split it was chosen by if the
+// route splits requests. returns nil if no route matched
+func (rt *Router) Route(r *http.Request) (*upstream.Upstream, *Split) {
+	if len(rt.routes) == 0 {
+		return nil, nil
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, rc := range rt.routes {
+		if rc.host != "" && rc.host != host {
+			continue
+		}
+		if !matchPath(rc.path, r.URL.Path) {
+			continue
+		}
+		if rc.splits != nil {
+			s := rc.pick(r)
+			return s.upstream, s
+		}
+		return rc.upstream, nil
+	}
+	return nil, nil
+}
+
+// matchPath : prefix match on path segment boundary
+func matchPath(prefix, path string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
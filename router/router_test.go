@@ -0,0 +1,120 @@
+package router
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/kazeburo/chocon/upstream"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRoute(t *testing.T) {
+	cfg := &Config{
+		Upstreams: []upstream.Config{
+			{Name: "api", URL: "http://127.0.0.1:8080/"},
+			{Name: "api-v2", URL: "http://127.0.0.1:8081/"},
+			{Name: "web", URL: "http://127.0.0.1:8082/"},
+		},
+		Routes: []Route{
+			{Path: "/", Upstream: "web"},
+			{Host: "api.example.com", Upstream: "api"},
+			{Host: "api.example.com", Path: "/v2", Upstream: "api-v2"},
+		},
+	}
+	rt, err := New(cfg, zap.NewNop())
+	assert.NoError(t, err)
+
+	cases := []struct {
+		host     string
+		path     string
+		upstream string
+	}{
+		{"api.example.com", "/v1/users", "api"},
+		{"API.example.com:3000", "/v1/users", "api"},
+		{"api.example.com", "/v2", "api-v2"},
+		{"api.example.com", "/v2/users", "api-v2"},
+		{"api.example.com", "/v20", "api"},
+		{"www.example.com", "/v2/users", "web"},
+	}
+	for _, c := range cases {
+		t.Run(c.host+c.path, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", c.path, nil)
+			r.Host = c.host
+			u, split := rt.Route(r)
+			assert.Nil(t, split)
+			if assert.NotNil(t, u) {
+				assert.Equal(t, c.upstream, u.Name())
+			}
+		})
+	}
+}
+
+func TestRouteNoRoute(t *testing.T) {
+	cfg := &Config{
+		Upstreams: []upstream.Config{
+			{Name: "api", URL: "http://127.0.0.1:8080/"},
+		},
+		Routes: []Route{
+			{Host: "api.example.com", Upstream: "api"},
+		},
+	}
+	rt, err := New(cfg, zap.NewNop())
+	assert.NoError(t, err)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Host = "example.com.ccnproxy"
+	u, split := rt.Route(r)
+	assert.Nil(t, u)
+	assert.Nil(t, split)
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := New(&Config{
+		Upstreams: []upstream.Config{
+			{Name: "api", URL: "http://127.0.0.1:8080/"},
+		},
+		Routes: []Route{
+			{Upstream: "unknown"},
+		},
+	}, zap.NewNop())
+	assert.Error(t, err)
+
+	_, err = New(&Config{
+		Upstreams: []upstream.Config{
+			{Name: "api", URL: "http://127.0.0.1:8080/"},
+			{Name: "api", URL: "http://127.0.0.1:8081/"},
+		},
+	}, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func TestBackup(t *testing.T) {
+	rt, err := New(&Config{
+		Upstreams: []upstream.Config{
+			{Name: "api", URL: "http://127.0.0.1:8080/", Backup: "api-dr"},
+			{Name: "api-dr", URL: "http://127.0.0.1:8081/", Backup: "sorry"},
+			{Name: "sorry", URL: "http://127.0.0.1:8082/"},
+		},
+	}, zap.NewNop())
+	if assert.NoError(t, err) {
+		u := rt.Upstreams()[0]
+		assert.Equal(t, "api-dr", u.Backup().Name())
+		assert.Equal(t, "sorry", u.Backup().Backup().Name())
+	}
+
+	_, err = New(&Config{
+		Upstreams: []upstream.Config{
+			{Name: "api", URL: "http://127.0.0.1:8080/", Backup: "unknown"},
+		},
+	}, zap.NewNop())
+	assert.Error(t, err)
+
+	_, err = New(&Config{
+		Upstreams: []upstream.Config{
+			{Name: "api", URL: "http://127.0.0.1:8080/", Backup: "api-dr"},
+			{Name: "api-dr", URL: "http://127.0.0.1:8081/", Backup: "api"},
+		},
+	}, zap.NewNop())
+	assert.Error(t, err)
+}
@@ -0,0 +1,139 @@
+package router
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/kazeburo/chocon/upstream"
+	"github.com/pkg/errors"
+)
+
+// SplitConfig : share of requests of a route sent to an upstream
+type SplitConfig struct {
+	// Name of the upstream pool
+	Upstream string `yaml:"upstream"`
+	// relative to the sum of weights of the route. 0 sends nothing
+	Weight int `yaml:"weight"`
+}
+
+// SplitBy : pin a client to one split by a request header or cookie.
+// requests without them are split randomly
+type SplitBy struct {
+	Header string `yaml:"header"`
+	Cookie string `yaml:"cookie"`
+}
+
+// Split : upstream of a route with its share and counters
+type Split struct {
+	upstream *upstream.Upstream
+	weight   int
+	requests atomic.Uint64
+	errors   atomic.Uint64
+}
+
+// Record : count a request answered with status. 5xx counts as error
+func (s *Split) Record(status int) {
+	s.requests.Add(1)
+	if status >= 500 {
+		s.errors.Add(1)
+	}
+}
+
+// SplitStatus : counters of a split
+type SplitStatus struct {
+	Upstream string `json:"upstream"`
+	Weight   int    `json:"weight"`
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+}
+
+// RouteSplitStatus : splits of a route
+type RouteSplitStatus struct {
+	Host   string         `json:"host"`
+	Path   string         `json:"path"`
+	Splits []*SplitStatus `json:"splits"`
+}
+
+func newSplits(rc Route, byName map[string]*upstream.Upstream) ([]*Split, error) {
+	total := 0
+	splits := make([]*Split, len(rc.Splits))
+	for i, sc := range rc.Splits {
+		u, ok := byName[sc.Upstream]
+		if !ok {
+			return nil, errors.Errorf("route refers unknown upstream: %s", sc.Upstream)
+		}
+		if sc.Weight < 0 {
+			return nil, errors.Errorf("weight of split %s should not be negative", sc.Upstream)
+		}
+		total += sc.Weight
+		splits[i] = &Split{upstream: u, weight: sc.Weight}
+	}
+	if total == 0 {
+		return nil, errors.New("sum of split weights should be positive")
+	}
+	if rc.SplitBy.Header != "" && rc.SplitBy.Cookie != "" {
+		return nil, errors.New("split_by header and cookie are exclusive")
+	}
+	return splits, nil
+}
+
+// pick : choose a split of route by weight. a client with the header or
+// cookie of split_by always gets the same split while weights are unchanged
+func (rc *route) pick(r *http.Request) *Split {
+	total := 0
+	for _, s := range rc.splits {
+		total += s.weight
+	}
+	var n int
+	if key, ok := rc.splitKey(r); ok {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		n = int(h.Sum32() % uint32(total))
+	} else {
+		n = rand.Intn(total)
+	}
+	for _, s := range rc.splits {
+		if n < s.weight {
+			return s
+		}
+		n -= s.weight
+	}
+	return rc.splits[len(rc.splits)-1]
+}
+
+func (rc *route) splitKey(r *http.Request) (string, bool) {
+	if rc.splitBy.Header != "" {
+		if v := r.Header.Get(rc.splitBy.Header); v != "" {
+			return v, true
+		}
+	}
+	if rc.splitBy.Cookie != "" {
+		if c, err := r.Cookie(rc.splitBy.Cookie); err == nil && c.Value != "" {
+			return c.Value, true
+		}
+	}
+	return "", false
+}
+
+// Splits : counters of routes with splits
+func (rt *Router) Splits() []*RouteSplitStatus {
+	st := []*RouteSplitStatus{}
+	for _, rc := range rt.routes {
+		if len(rc.splits) == 0 {
+			continue
+		}
+		rs := &RouteSplitStatus{Host: rc.host, Path: rc.path}
+		for _, s := range rc.splits {
+			rs.Splits = append(rs.Splits, &SplitStatus{
+				Upstream: s.upstream.Name(),
+				Weight:   s.weight,
+				Requests: s.requests.Load(),
+				Errors:   s.errors.Load(),
+			})
+		}
+		st = append(st, rs)
+	}
+	return st
+}
@@ -0,0 +1,100 @@
+package router
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/kazeburo/chocon/upstream"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func newSplitRouter(t *testing.T, splitBy SplitBy) *Router {
+	rt, err := New(&Config{
+		Upstreams: []upstream.Config{
+			{Name: "stable", URL: "http://127.0.0.1:8080/"},
+			{Name: "canary", URL: "http://127.0.0.1:8081/"},
+		},
+		Routes: []Route{
+			{
+				Host: "api.example.com",
+				Splits: []SplitConfig{
+					{Upstream: "stable", Weight: 90},
+					{Upstream: "canary", Weight: 10},
+				},
+				SplitBy: splitBy,
+			},
+		},
+	}, zap.NewNop())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return rt
+}
+
+func TestSplit(t *testing.T) {
+	rt := newSplitRouter(t, SplitBy{})
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Host = "api.example.com"
+	seen := map[string]int{}
+	for i := 0; i < 2000; i++ {
+		u, split := rt.Route(r)
+		if assert.NotNil(t, split) {
+			seen[u.Name()]++
+			status := http.StatusOK
+			if u.Name() == "canary" {
+				status = http.StatusBadGateway
+			}
+			split.Record(status)
+		}
+	}
+	assert.InDelta(t, 1800, seen["stable"], 100)
+	assert.InDelta(t, 200, seen["canary"], 100)
+
+	st := rt.Splits()
+	if assert.Len(t, st, 1) {
+		assert.Equal(t, "api.example.com", st[0].Host)
+		assert.Equal(t, "stable", st[0].Splits[0].Upstream)
+		assert.Equal(t, uint64(seen["stable"]), st[0].Splits[0].Requests)
+		assert.Equal(t, uint64(0), st[0].Splits[0].Errors)
+		assert.Equal(t, uint64(seen["canary"]), st[0].Splits[1].Requests)
+		assert.Equal(t, uint64(seen["canary"]), st[0].Splits[1].Errors)
+	}
+}
+
+func TestSplitBy(t *testing.T) {
+	for _, by := range []SplitBy{{Header: "X-User-Id"}, {Cookie: "session"}} {
+		rt := newSplitRouter(t, by)
+		seen := map[string]int{}
+		for i := 0; i < 50; i++ {
+			r, _ := http.NewRequest("GET", "/", nil)
+			r.Host = "api.example.com"
+			if by.Header != "" {
+				r.Header.Set(by.Header, "user-42")
+			} else {
+				r.AddCookie(&http.Cookie{Name: by.Cookie, Value: "user-42"})
+			}
+			u, _ := rt.Route(r)
+			seen[u.Name()]++
+		}
+		assert.Len(t, seen, 1, "client stays on one side")
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	upstreams := []upstream.Config{
+		{Name: "stable", URL: "http://127.0.0.1:8080/"},
+		{Name: "canary", URL: "http://127.0.0.1:8081/"},
+	}
+	routes := []Route{
+		{Upstream: "stable", Splits: []SplitConfig{{Upstream: "canary", Weight: 1}}},
+		{Splits: []SplitConfig{{Upstream: "unknown", Weight: 1}}},
+		{Splits: []SplitConfig{{Upstream: "stable", Weight: 0}}},
+		{Splits: []SplitConfig{{Upstream: "stable", Weight: -1}, {Upstream: "canary", Weight: 2}}},
+		{Splits: []SplitConfig{{Upstream: "stable", Weight: 1}}, SplitBy: SplitBy{Header: "X-User-Id", Cookie: "session"}},
+	}
+	for _, rc := range routes {
+		_, err := New(&Config{Upstreams: upstreams, Routes: []Route{rc}}, zap.NewNop())
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,68 @@
+package upstream
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SetBackup : pool that serves requests while this pool has no usable IPs
+func (u *Upstream) SetBackup(b *Upstream) {
+	u.backup = b
+}
+
+// Backup : backup pool. nil if none
+func (u *Upstream) Backup() *Upstream {
+	return u.backup
+}
+
+// available : any IP is usable and its circuit is not open
+func (u *Upstream) available(now time.Time) bool {
+	for _, ipwc := range u.IPwcs() {
+		if ipwc.usable(now) && ipwc.breakerReady(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Select : this pool, or the first available pool in the chain of backups
+// if this pool has no usable IPs. this pool is returned if no pool is
+// available, so that requests fail open as without backup
+func (u *Upstream) Select() *Upstream {
+	if u.backup == nil {
+		return u
+	}
+	now := time.Now()
+	active := u
+	for p := u; p != nil; p = p.backup {
+		if p.available(now) {
+			active = p
+			break
+		}
+	}
+	prev := u.active.Swap(active)
+	if prev == nil {
+		prev = u
+	}
+	if prev != active {
+		fields := []zap.Field{
+			zap.String("from", prev.name),
+			zap.String("to", active.name),
+		}
+		if active == u {
+			u.logger.Info("failback to primary pool", fields...)
+		} else {
+			u.logger.Warn("failover to backup pool", fields...)
+		}
+	}
+	return active
+}
+
+// Active : pool serving requests of this pool at last Select
+func (u *Upstream) Active() *Upstream {
+	if active := u.active.Load(); active != nil {
+		return active
+	}
+	return u
+}
@@ -0,0 +1,54 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectBackup(t *testing.T) {
+	primary := newTestUpstream(2)
+	primary.name = "api"
+	assert.Equal(t, primary, primary.Select(), "no backup")
+
+	backup := newTestUpstream(1)
+	backup.name = "api-dr"
+	last := newTestUpstream(1)
+	last.name = "sorry"
+	primary.SetBackup(backup)
+	backup.SetBackup(last)
+
+	assert.Equal(t, primary, primary.Select())
+	assert.Equal(t, "api", primary.Status().Active)
+	assert.Equal(t, "api-dr", primary.Status().Backup)
+
+	// one IP is enough for primary
+	ipwcs := primary.IPwcs()
+	ipwcs[0].healthy.Store(false)
+	assert.Equal(t, primary, primary.Select())
+
+	// failover when no IP is usable
+	ipwcs[1].ejectedUntil.Store(time.Now().Add(time.Hour).UnixNano())
+	assert.Equal(t, backup, primary.Select())
+	assert.Equal(t, "api-dr", primary.Status().Active)
+
+	// next tier
+	backup.IPwcs()[0].healthy.Store(false)
+	assert.Equal(t, last, primary.Select())
+
+	// no pool is available. fail open to primary
+	last.IPwcs()[0].healthy.Store(false)
+	assert.Equal(t, primary, primary.Select())
+
+	// failback when primary recovers
+	last.IPwcs()[0].healthy.Store(true)
+	assert.Equal(t, last, primary.Select())
+	ipwcs[0].healthy.Store(true)
+	assert.Equal(t, primary, primary.Select())
+	assert.Equal(t, "api", primary.Status().Active)
+
+	// empty pool
+	primary.ipwcs.Store(&[]*IPwc{})
+	assert.Equal(t, last, primary.Select())
+}
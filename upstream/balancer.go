@@ -0,0 +1,269 @@
+package upstream
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BalancerConfig : load balancing algorithm of upstream pool
+type BalancerConfig struct {
+	// least_busy (default), round_robin, weighted_round_robin, p2c, peak_ewma or hash
+	Type string `yaml:"type"`
+	// request key of hash: header:<name>, cookie:<name> or client_ip
+	HashKey string `yaml:"hash_key"`
+	// decay time of peak_ewma. default 10s
+	Decay time.Duration `yaml:"decay"`
+}
+
+// Balancer : choose an IP from candidates. candidates is never empty.
+// Pick is called concurrently and must not modify candidates
+type Balancer interface {
+	Pick(candidates []*IPwc, r *http.Request) *IPwc
+}
+
+// latencyObserver : balancer that needs latency of finished requests
+type latencyObserver interface {
+	Observe(ipwc *IPwc, d time.Duration)
+}
+
+func newBalancer(cfg BalancerConfig) (Balancer, error) {
+	switch cfg.Type {
+	case "", "least_busy":
+		return &leastBusy{}, nil
+	case "round_robin":
+		return &roundRobin{}, nil
+	case "weighted_round_robin":
+		return &weightedRoundRobin{}, nil
+	case "p2c":
+		return &p2c{}, nil
+	case "peak_ewma":
+		decay := cfg.Decay
+		if decay <= 0 {
+			decay = 10 * time.Second
+		}
+		return &peakEWMA{decay: decay}, nil
+	case "hash":
+		kind, name, _ := strings.Cut(cfg.HashKey, ":")
+		switch kind {
+		case "header", "cookie":
+			if name == "" {
+				return nil, errors.Errorf("hash_key requires name: %s", cfg.HashKey)
+			}
+		case "client_ip":
+		default:
+			return nil, errors.Errorf("hash_key should be header:<name>, cookie:<name> or client_ip: %s", cfg.HashKey)
+		}
+		return &hashBalancer{kind: kind, name: name}, nil
+	}
+	return nil, errors.Errorf("unknown balancer type: %s", cfg.Type)
+}
+
+// leastBusy : least busy relative to weight. scanning from random offset breaks ties
+type leastBusy struct{}
+
+func (b *leastBusy) Pick(candidates []*IPwc, _ *http.Request) *IPwc {
+	n := len(candidates)
+	offset := 0
+	if n > 1 {
+		offset = rand.Intn(n)
+	}
+	best := candidates[offset]
+	bestBusy := best.busy.Load()
+	bestWeight := best.effectiveWeight()
+	for i := 1; i < n; i++ {
+		c := candidates[(offset+i)%n]
+		busy := c.busy.Load()
+		if w := c.effectiveWeight(); lessBusy(busy, w, bestBusy, bestWeight) {
+			best = c
+			bestBusy = busy
+			bestWeight = w
+		}
+	}
+	return best
+}
+
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+func (b *roundRobin) Pick(candidates []*IPwc, _ *http.Request) *IPwc {
+	n := b.next.Add(1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+// weightedRoundRobin : smooth weighted round-robin
+type weightedRoundRobin struct {
+	mu sync.Mutex
+	// current weight by ip:port
+	current map[string]int64
+}
+
+func (b *weightedRoundRobin) Pick(candidates []*IPwc, _ *http.Request) *IPwc {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current == nil || len(b.current) > 2*len(candidates) {
+		// forget IPs no longer resolved
+		b.current = make(map[string]int64, len(candidates))
+	}
+	var total int64
+	var best *IPwc
+	var bestWeight int64
+	for _, c := range candidates {
+		w := c.effectiveWeight()
+		cw := b.current[c.host] + w
+		b.current[c.host] = cw
+		total += w
+		if best == nil || cw > bestWeight {
+			best = c
+			bestWeight = cw
+		}
+	}
+	b.current[best.host] -= total
+	return best
+}
+
+// lessBusy : (a+1)/aw < (b+1)/bw. compares load after adding a request,
+// so that an idle IP with low weight is not always preferred
+func lessBusy(a, aw, b, bw int64) bool {
+	return (a+1)*bw < (b+1)*aw
+}
+
+// p2c : power of two choices on busy count relative to weight
+type p2c struct{}
+
+func (b *p2c) Pick(candidates []*IPwc, _ *http.Request) *IPwc {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	i, j := pickTwo(len(candidates))
+	ci, cj := candidates[i], candidates[j]
+	if lessBusy(cj.busy.Load(), cj.effectiveWeight(), ci.busy.Load(), ci.effectiveWeight()) {
+		return cj
+	}
+	return ci
+}
+
+func pickTwo(n int) (int, int) {
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	return i, j
+}
+
+// peakEWMA : power of two choices on peak EWMA latency multiplied by busy count
+type peakEWMA struct {
+	decay time.Duration
+}
+
+// penalty : cost of busy IP without latency observation
+const ewmaPenalty = float64(time.Second)
+
+func (b *peakEWMA) cost(c *IPwc) float64 {
+	busy := c.busy.Load()
+	c.mu.Lock()
+	ewma := c.ewma
+	c.mu.Unlock()
+	// higher cost in slow start
+	f := float64(c.weight*weightScale) / float64(c.effectiveWeight())
+	if ewma == 0 {
+		return ewmaPenalty * float64(busy) * f
+	}
+	return ewma * float64(busy+1) * f
+}
+
+func (b *peakEWMA) Pick(candidates []*IPwc, _ *http.Request) *IPwc {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	i, j := pickTwo(len(candidates))
+	if b.cost(candidates[j]) < b.cost(candidates[i]) {
+		return candidates[j]
+	}
+	return candidates[i]
+}
+
+func (b *peakEWMA) Observe(c *IPwc, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	rtt := float64(d)
+	if rtt > c.ewma {
+		c.ewma = rtt
+	} else {
+		w := math.Exp(-float64(now.Sub(c.ewmaStamp)) / float64(b.decay))
+		c.ewma = c.ewma*w + rtt*(1-w)
+	}
+	c.ewmaStamp = now
+}
+
+// hashBalancer : weighted rendezvous hashing on a request key
+type hashBalancer struct {
+	kind     string
+	name     string
+	fallback leastBusy
+}
+
+func (b *hashBalancer) key(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	switch b.kind {
+	case "header":
+		return r.Header.Get(b.name)
+	case "cookie":
+		if c, err := r.Cookie(b.name); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (b *hashBalancer) Pick(candidates []*IPwc, r *http.Request) *IPwc {
+	key := b.key(r)
+	if key == "" {
+		return b.fallback.Pick(candidates, r)
+	}
+	var best *IPwc
+	bestScore := math.Inf(-1)
+	for _, c := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(c.host))
+		x := mix64(h.Sum64())
+		// map to (0,1) and weight it
+		f := (float64(x>>11) + 0.5) / (1 << 53)
+		score := -float64(c.effectiveWeight()) / math.Log(f)
+		if score > bestScore {
+			best = c
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// mix64 : splitmix64 finalizer
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,128 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCandidates() []*IPwc {
+	return []*IPwc{
+		testIPwc("192.0.2.1", 1),
+		testIPwc("192.0.2.2", 2),
+		testIPwc("192.0.2.3", 3),
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	b, err := newBalancer(BalancerConfig{Type: "round_robin"})
+	assert.NoError(t, err)
+	candidates := testCandidates()
+	for i := 0; i < 6; i++ {
+		assert.Equal(t, candidates[i%3].ip, b.Pick(candidates, nil).ip)
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	b, err := newBalancer(BalancerConfig{Type: "weighted_round_robin"})
+	assert.NoError(t, err)
+	candidates := testCandidates()
+	counts := map[string]int{}
+	for i := 0; i < 60; i++ {
+		counts[b.Pick(candidates, nil).ip]++
+	}
+	assert.Equal(t, map[string]int{"192.0.2.1": 10, "192.0.2.2": 20, "192.0.2.3": 30}, counts)
+}
+
+func TestP2C(t *testing.T) {
+	b, err := newBalancer(BalancerConfig{Type: "p2c"})
+	assert.NoError(t, err)
+	candidates := []*IPwc{testIPwc("192.0.2.1", 1), testIPwc("192.0.2.2", 1)}
+	candidates[0].busy.Store(10)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "192.0.2.2", b.Pick(candidates, nil).ip)
+	}
+}
+
+func TestPeakEWMA(t *testing.T) {
+	b, err := newBalancer(BalancerConfig{Type: "peak_ewma"})
+	assert.NoError(t, err)
+	candidates := []*IPwc{testIPwc("192.0.2.1", 1), testIPwc("192.0.2.2", 1)}
+	lo := b.(latencyObserver)
+	lo.Observe(candidates[0], 500*time.Millisecond)
+	lo.Observe(candidates[1], 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "192.0.2.2", b.Pick(candidates, nil).ip)
+	}
+	// peak is taken immediately
+	lo.Observe(candidates[1], time.Second)
+	assert.Equal(t, "192.0.2.1", b.Pick(candidates, nil).ip)
+}
+
+func TestHashBalancer(t *testing.T) {
+	_, err := newBalancer(BalancerConfig{Type: "hash", HashKey: "header"})
+	assert.Error(t, err)
+
+	b, err := newBalancer(BalancerConfig{Type: "hash", HashKey: "header:X-User-Id"})
+	assert.NoError(t, err)
+	candidates := testCandidates()
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User-Id", "user-1")
+	first := b.Pick(candidates, r).ip
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, b.Pick(candidates, r).ip)
+	}
+
+	// removing another IP keeps affinity
+	rest := []*IPwc{}
+	for _, c := range candidates {
+		if c.ip == first {
+			rest = append(rest, c)
+		}
+	}
+	for _, c := range candidates {
+		if c.ip != first {
+			rest = append(rest, c)
+			break
+		}
+	}
+	assert.Equal(t, first, b.Pick(rest, r).ip)
+
+	b, err = newBalancer(BalancerConfig{Type: "hash", HashKey: "cookie:session"})
+	assert.NoError(t, err)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	first = b.Pick(candidates, r).ip
+	assert.Equal(t, first, b.Pick(candidates, r).ip)
+}
+
+func TestBalancerSameIPPorts(t *testing.T) {
+	u := &Upstream{weights: map[string]int64{"192.0.2.1:8081": 3, "192.0.2.1": 2}}
+	candidates := []*IPwc{
+		u.newIPwc(target{ip: "192.0.2.1", port: "8080", weight: 1}),
+		u.newIPwc(target{ip: "192.0.2.1", port: "8081", weight: 1}),
+	}
+	assert.Equal(t, int64(2), candidates[0].weight, "weight by IP")
+	assert.Equal(t, int64(3), candidates[1].weight, "weight by ip:port")
+
+	b, err := newBalancer(BalancerConfig{Type: "weighted_round_robin"})
+	assert.NoError(t, err)
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		counts[b.Pick(candidates, nil).host]++
+	}
+	assert.Equal(t, map[string]int{"192.0.2.1:8080": 4, "192.0.2.1:8081": 6}, counts)
+
+	b, err = newBalancer(BalancerConfig{Type: "hash", HashKey: "header:X-User-Id"})
+	assert.NoError(t, err)
+	counts = map[string]int{}
+	for i := 0; i < 100; i++ {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User-Id", fmt.Sprintf("user-%d", i))
+		counts[b.Pick(candidates, r).host]++
+	}
+	assert.Len(t, counts, 2, "ports of an IP get different scores")
+}
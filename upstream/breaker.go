@@ -0,0 +1,45 @@
+package upstream
+
+import (
+	"time"
+
+	"github.com/kazeburo/chocon/breaker"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ErrCircuitOpen : circuits of all IPs are open
+var ErrCircuitOpen = errors.New("circuit open")
+
+// newBreaker : circuit breaker of an IP. nil if disabled
+func (u *Upstream) newBreaker(host string) *breaker.Breaker {
+	if u.circuitBreaker == nil {
+		return nil
+	}
+	return breaker.New(*u.circuitBreaker, func(from, to breaker.State) {
+		fields := []zap.Field{
+			zap.String("ip", host),
+			zap.String("from", from.String()),
+			zap.String("to", to.String()),
+		}
+		if to == breaker.Open {
+			u.logger.Warn("circuit breaker state changed", fields...)
+			return
+		}
+		u.logger.Info("circuit breaker state changed", fields...)
+	})
+}
+
+// breakerReady : circuit of the IP accepts a request
+func (ipwc *IPwc) breakerReady(now time.Time) bool {
+	return ipwc.breaker == nil || ipwc.breaker.Ready(now)
+}
+
+// breakerDone : feed outcome of a per-request copy to circuit breaker
+func (ipwc *IPwc) breakerDone() {
+	if ipwc.done == nil {
+		return
+	}
+	ipwc.done(ipwc.outcome)
+	ipwc.done = nil
+}
@@ -0,0 +1,49 @@
+package upstream
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kazeburo/chocon/breaker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCircuitBreaker(t *testing.T) {
+	u := newTestUpstream(0)
+	u.circuitBreaker = &breaker.Config{FailureThreshold: 2, OpenDuration: time.Hour}
+	ipwcs := []*IPwc{
+		u.newIPwc(target{ip: "192.0.2.1", port: "8080"}),
+		u.newIPwc(target{ip: "192.0.2.2", port: "8080"}),
+	}
+	u.ipwcs.Store(&ipwcs)
+	dialErr := errors.New("connection refused")
+
+	// failures open circuit of 192.0.2.1
+	for i := 0; i < 2; i++ {
+		_, ipwc, err := u.Get(nil, &IPwc{origin: ipwcs[1]})
+		assert.NoError(t, err)
+		u.Report(ipwc, dialErr)
+		u.Release(ipwc)
+	}
+	assert.Equal(t, breaker.Open, ipwcs[0].breaker.State())
+	for i := 0; i < 3; i++ {
+		h, ipwc, err := u.Get(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "192.0.2.2:8080", h)
+		u.Release(ipwc)
+	}
+	_, ipwc, err := u.Get(nil, &IPwc{origin: ipwcs[1]})
+	assert.Equal(t, ErrCircuitOpen, err)
+	u.Release(ipwc)
+
+	// request without report does not count as success nor failure
+	_, ipwc, err = u.Get(nil)
+	assert.NoError(t, err)
+	u.Release(ipwc)
+	assert.Equal(t, 0, ipwcs[1].breaker.Stats().Failures)
+
+	st := u.Status()
+	assert.Equal(t, "open", st.IPs[0].Breaker.State)
+	assert.Equal(t, "closed", st.IPs[1].Breaker.State)
+}
@@ -0,0 +1,223 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ConsulConfig : discover members by Consul-compatible health API
+type ConsulConfig struct {
+	// address of HTTP API. default http://127.0.0.1:8500
+	Address string `yaml:"address"`
+	// service name
+	Service string `yaml:"service"`
+	// instances must have all of these tags
+	Tags       []string `yaml:"tags"`
+	Datacenter string   `yaml:"datacenter"`
+	// sent as X-Consul-Token
+	Token string `yaml:"token"`
+	// wait of blocking query. default 5m. -1 disables blocking queries and
+	// the service is polled at refresh interval of resolver
+	Wait time.Duration `yaml:"wait"`
+}
+
+func (cc *ConsulConfig) setDefaults() error {
+	if cc.Service == "" {
+		return errors.New("consul service is required")
+	}
+	if cc.Address == "" {
+		cc.Address = "http://127.0.0.1:8500"
+	}
+	if cc.Wait == 0 {
+		cc.Wait = 5 * time.Minute
+	}
+	return nil
+}
+
+// consulEntry : an entry of /v1/health/service/:service
+type consulEntry struct {
+	Node struct {
+		Address string
+		Meta    map[string]string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+		Weights struct {
+			Passing int64
+		}
+	}
+}
+
+// consulDiscovery : latest members watched by blocking queries
+type consulDiscovery struct {
+	cfg    ConsulConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	index   uint64
+	members []MemberConfig
+	err     error
+	fetched bool
+}
+
+func newConsulDiscovery(cfg ConsulConfig) *consulDiscovery {
+	timeout := 30 * time.Second
+	if cfg.Wait > 0 {
+		// server adds up to wait/16 of jitter
+		timeout += cfg.Wait + cfg.Wait/16
+	}
+	return &consulDiscovery{
+		cfg:    cfg,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// fetch : query passing instances. blocks until index changes if index > 0
+func (cd *consulDiscovery) fetch(ctx context.Context, index uint64) ([]MemberConfig, uint64, error) {
+	q := url.Values{}
+	q.Set("passing", "true")
+	for _, tag := range cd.cfg.Tags {
+		q.Add("tag", tag)
+	}
+	if cd.cfg.Datacenter != "" {
+		q.Set("dc", cd.cfg.Datacenter)
+	}
+	if index > 0 && cd.cfg.Wait > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", strconv.FormatInt(cd.cfg.Wait.Milliseconds(), 10)+"ms")
+	}
+	u := cd.cfg.Address + "/v1/health/service/" + url.PathEscape(cd.cfg.Service) + "?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if cd.cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", cd.cfg.Token)
+	}
+	res, err := cd.client.Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "consul query failed")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, errors.Errorf("consul query failed: status %d", res.StatusCode)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		return nil, 0, errors.Wrap(err, "could not parse consul response")
+	}
+	newIndex, _ := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+
+	members := make([]MemberConfig, 0, len(entries))
+	for _, e := range entries {
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+		// zone of service meta, or of node meta
+		zone := e.Service.Meta["zone"]
+		if zone == "" {
+			zone = e.Node.Meta["zone"]
+		}
+		members = append(members, MemberConfig{
+			Host:   net.JoinHostPort(addr, strconv.Itoa(e.Service.Port)),
+			Weight: e.Service.Weights.Passing,
+			Zone:   zone,
+		})
+	}
+	return members, newIndex, nil
+}
+
+func (cd *consulDiscovery) store(members []MemberConfig, index uint64, err error) {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	cd.fetched = true
+	cd.err = err
+	if err != nil {
+		return
+	}
+	cd.members = members
+	cd.index = index
+}
+
+// lookupConsul : members from last result of watch, or fetched now
+// if blocking queries are disabled
+func (u *Upstream) lookupConsul(ctx context.Context) ([]target, time.Duration, error) {
+	cd := u.consul
+	cd.mu.Lock()
+	fetched, members, err := cd.fetched, cd.members, cd.err
+	cd.mu.Unlock()
+	if !fetched || cd.cfg.Wait < 0 {
+		var index uint64
+		members, index, err = cd.fetch(ctx, 0)
+		cd.store(members, index, err)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	targets, _, err := u.lookupMembers(ctx, members)
+	// refresh interval does not follow TTL of addresses.
+	// changes of the service are delivered by watch
+	return targets, 0, err
+}
+
+// watchConsul : refresh IPs when the service changes
+func (u *Upstream) watchConsul(ctx context.Context) {
+	cd := u.consul
+	backoff := time.Second
+	for {
+		cd.mu.Lock()
+		index := cd.index
+		cd.mu.Unlock()
+
+		members, newIndex, err := cd.fetch(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			u.logger.Warn("failed consul watch", zap.Error(err))
+			cd.store(nil, 0, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		if newIndex < index {
+			// index went backwards. start over
+			newIndex = 0
+		}
+		cd.store(members, newIndex, nil)
+		if newIndex != index || newIndex == 0 {
+			select {
+			case u.reload <- struct{}{}:
+			default:
+			}
+		}
+		if newIndex == 0 {
+			// not a blocking query server. avoid busy loop
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package upstream
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// consulStub : stand-in of Consul health API supporting blocking queries
+type consulStub struct {
+	mu      sync.Mutex
+	index   uint64
+	entries []map[string]interface{}
+	changed chan struct{}
+	// closed to abort blocking queries
+	done chan struct{}
+}
+
+func newConsulStub(t *testing.T) (*consulStub, *httptest.Server) {
+	s := &consulStub{changed: make(chan struct{}), done: make(chan struct{})}
+	ts := httptest.NewServer(s)
+	t.Cleanup(func() {
+		close(s.done)
+		ts.Close()
+	})
+	return s, ts
+}
+
+func (s *consulStub) set(entries ...map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index++
+	s.entries = entries
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *consulStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/api" || r.URL.Query().Get("passing") != "true" ||
+		r.URL.Query().Get("tag") != "v1" || r.Header.Get("X-Consul-Token") != "secret" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	changed := s.changed
+	index := s.index
+	s.mu.Unlock()
+	if i, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); i > 0 && i == index {
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	json.NewEncoder(w).Encode(s.entries)
+}
+
+func consulInstance(node, addr string, port int, weight int) map[string]interface{} {
+	return map[string]interface{}{
+		"Node": map[string]interface{}{"Address": node},
+		"Service": map[string]interface{}{
+			"Address": addr,
+			"Port":    port,
+			"Tags":    []string{"v1"},
+			"Weights": map[string]interface{}{"Passing": weight, "Warning": 1},
+		},
+	}
+}
+
+func TestConsulDiscovery(t *testing.T) {
+	stub, ts := newConsulStub(t)
+	stub.set(consulInstance("192.0.2.1", "", 8080, 1))
+
+	u, err := New(Config{
+		Name: "api",
+		URL:  "http://api.service/",
+		Consul: &ConsulConfig{
+			Address: ts.URL,
+			Service: "api",
+			Tags:    []string{"v1"},
+			Token:   "secret",
+			Wait:    time.Minute,
+		},
+	}, zap.NewNop())
+	assert.NoError(t, err)
+	assert.Len(t, u.IPwcs(), 1)
+	assert.Equal(t, "192.0.2.1:8080", u.IPwcs()[0].host)
+
+	// change is delivered by blocking query without waiting refresh interval
+	stub.set(
+		consulInstance("192.0.2.1", "", 8080, 1),
+		consulInstance("192.0.2.9", "192.0.2.2", 9090, 5),
+	)
+	assert.Eventually(t, func() bool {
+		return len(u.IPwcs()) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	for _, ipwc := range u.IPwcs() {
+		if ipwc.ip == "192.0.2.2" {
+			assert.Equal(t, "192.0.2.2:9090", ipwc.host)
+			assert.Equal(t, int64(5), ipwc.weight)
+		}
+	}
+
+	_, err = New(Config{URL: "http://api.service/", Consul: &ConsulConfig{}}, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func TestConsulPolling(t *testing.T) {
+	stub, ts := newConsulStub(t)
+	stub.set(consulInstance("192.0.2.1", "", 8080, 1))
+
+	u, err := New(Config{
+		Name: "api",
+		URL:  "http://api.service/",
+		Consul: &ConsulConfig{
+			Address: ts.URL, Service: "api", Tags: []string{"v1"}, Token: "secret", Wait: -1,
+		},
+	}, zap.NewNop())
+	assert.NoError(t, err)
+	assert.Len(t, u.IPwcs(), 1)
+
+	// empty answer keeps current members
+	stub.set()
+	_, err = u.RefreshIP(t.Context())
+	assert.Error(t, err)
+	assert.Len(t, u.IPwcs(), 1)
+}
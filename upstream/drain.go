@@ -0,0 +1,84 @@
+package upstream
+
+import (
+	"net"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// trackedConn : connection dialed for an IP, closed when the IP is removed
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	untrack func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.untrack)
+	return c.Conn.Close()
+}
+
+// track : register conn dialed to addr
+func (u *Upstream) track(addr string, conn net.Conn) net.Conn {
+	tc := &trackedConn{Conn: conn}
+	tc.untrack = func() {
+		u.connsMu.Lock()
+		defer u.connsMu.Unlock()
+		delete(u.conns[addr], tc)
+		if len(u.conns[addr]) == 0 {
+			delete(u.conns, addr)
+		}
+	}
+	u.connsMu.Lock()
+	defer u.connsMu.Unlock()
+	if u.conns == nil {
+		u.conns = make(map[string]map[*trackedConn]struct{})
+	}
+	if u.conns[addr] == nil {
+		u.conns[addr] = make(map[*trackedConn]struct{})
+	}
+	u.conns[addr][tc] = struct{}{}
+	return tc
+}
+
+// drain : IP was removed from the pool. its connections are closed
+// once its in-flight requests finish
+func (u *Upstream) drain(ipwc *IPwc) {
+	ipwc.removed.Store(true)
+	u.logger.Info("drain removed upstream ip",
+		zap.String("ip", ipwc.host),
+		zap.Uint64("version", ipwc.version),
+		zap.Uint64("current_version", u.version),
+		zap.Int64("busy", ipwc.busy.Load()),
+	)
+	if ipwc.busy.Load() == 0 {
+		u.closeConns(ipwc)
+	}
+}
+
+// closeConns : close connections to removed IP unless it has been resolved again
+func (u *Upstream) closeConns(ipwc *IPwc) {
+	addr := u.dialAddr(ipwc)
+	for _, c := range u.IPwcs() {
+		if u.dialAddr(c) == addr {
+			return
+		}
+	}
+	u.connsMu.Lock()
+	conns := make([]*trackedConn, 0, len(u.conns[addr]))
+	for c := range u.conns[addr] {
+		conns = append(conns, c)
+	}
+	u.connsMu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	if len(conns) > 0 {
+		u.logger.Info("closed connections to removed upstream ip",
+			zap.String("ip", ipwc.host),
+			zap.Uint64("version", ipwc.version),
+			zap.Int("conns", len(conns)),
+		)
+	}
+}
@@ -0,0 +1,71 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDrainRemovedIP(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+			}
+		}()
+		listeners = append(listeners, l)
+	}
+	members := []MemberConfig{{Host: listeners[0].Addr().String()}, {Host: listeners[1].Addr().String()}}
+	u, err := New(Config{URL: "http://backend.internal/", Members: members}, zap.NewNop())
+	assert.NoError(t, err)
+
+	// a request in flight to the first IP
+	var inflight *IPwc
+	var host string
+	for inflight == nil {
+		h, ipwc, err := u.Get(nil)
+		assert.NoError(t, err)
+		if h == listeners[0].Addr().String() {
+			inflight, host = ipwc, h
+			continue
+		}
+		u.Release(ipwc)
+	}
+	d := &net.Dialer{Timeout: time.Second}
+	conn, err := u.DialContext(context.Background(), d, "tcp", host)
+	assert.NoError(t, err)
+	idle, err := u.DialContext(context.Background(), d, "tcp", listeners[1].Addr().String())
+	assert.NoError(t, err)
+	defer idle.Close()
+
+	u.lookup = func(ctx context.Context) ([]target, time.Duration, error) {
+		return u.lookupMembers(ctx, members[1:])
+	}
+	_, err = u.RefreshIP(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, u.IPwcs(), 1)
+
+	// kept while the request is in flight
+	_, err = conn.Write([]byte("x"))
+	assert.NoError(t, err)
+
+	u.Release(inflight)
+	_, err = conn.Write([]byte("x"))
+	assert.Error(t, err)
+	u.connsMu.Lock()
+	assert.Len(t, u.conns, 1)
+	assert.Len(t, u.conns[listeners[1].Addr().String()], 1)
+	u.connsMu.Unlock()
+}
@@ -0,0 +1,150 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// address families
+const (
+	familyAny        = ""
+	familyIPv4       = "ipv4"
+	familyIPv6       = "ipv6"
+	familyPreferIPv4 = "prefer_ipv4"
+	familyPreferIPv6 = "prefer_ipv6"
+)
+
+// defaultFallbackDelay : delay before falling back to the other address family. same as net.Dialer
+const defaultFallbackDelay = 300 * time.Millisecond
+
+func checkFamily(family string) error {
+	switch family {
+	case familyAny, familyIPv4, familyIPv6, familyPreferIPv4, familyPreferIPv6:
+		return nil
+	}
+	return errors.Errorf("address_family should be ipv4, ipv6, prefer_ipv4 or prefer_ipv6: %s", family)
+}
+
+func isIPv4(ip string) bool {
+	p := net.ParseIP(ip)
+	return p != nil && p.To4() != nil
+}
+
+// filterFamily : drop targets of the other family if the family is restricted
+func (u *Upstream) filterFamily(targets []target) []target {
+	if u.family != familyIPv4 && u.family != familyIPv6 {
+		return targets
+	}
+	v4 := u.family == familyIPv4
+	filtered := targets[:0:0]
+	for _, t := range targets {
+		if isIPv4(t.ip) == v4 {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
+
+// familyRank : 0 for preferred family, 1 for the other
+func (u *Upstream) familyRank(ip string) uint8 {
+	switch u.family {
+	case familyPreferIPv4:
+		if !isIPv4(ip) {
+			return 1
+		}
+	case familyPreferIPv6:
+		if isIPv4(ip) {
+			return 1
+		}
+	}
+	return 0
+}
+
+// hostPort : join host and port. IPv6 literal is bracketed even without port
+func hostPort(host, port string) string {
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	if net.ParseIP(host) != nil && !isIPv4(host) {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// ErrFallbackDelay : dial was given up after happy eyeballs delay to fall
+// back to the other address family. it is not a failure of the IP
+var ErrFallbackDelay = errors.New("no connection within happy eyeballs delay")
+
+type fallbackKey struct{}
+
+// WithFallback : mark context of a request that falls back to the other
+// address family when the chosen IP does not connect within happy eyeballs delay
+func WithFallback(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fallbackKey{}, true)
+}
+
+// HappyEyeballs : requests can fall back to the other address family
+func (u *Upstream) HappyEyeballs() bool {
+	if u.fallbackDelay < 0 {
+		return false
+	}
+	var v4, v6 bool
+	for _, ipwc := range u.IPwcs() {
+		if isIPv4(ipwc.ip) {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	return v4 && v6
+}
+
+// DialContext : dial addr chosen by Get. connection is closed when the IP
+// is removed from the pool. dial of a request marked by WithFallback gives up
+// after happy eyeballs delay if an IP of the other family is usable
+func (u *Upstream) DialContext(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	dialCtx := ctx
+	if fallback, _ := ctx.Value(fallbackKey{}).(bool); fallback && u.fallbackDelay >= 0 {
+		if host, _, err := net.SplitHostPort(addr); err == nil && u.hasFallback(!isIPv4(host)) {
+			var cancel context.CancelFunc
+			dialCtx, cancel = context.WithTimeout(ctx, u.fallbackDelay)
+			defer cancel()
+		}
+	}
+	conn, err := d.DialContext(dialCtx, network, addr)
+	if err != nil {
+		if dialCtx != ctx && ctx.Err() == nil && dialCtx.Err() == context.DeadlineExceeded {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: ErrFallbackDelay}
+		}
+		return nil, err
+	}
+	return u.track(addr, conn), nil
+}
+
+// hasFallback : a usable IP in the other family exists
+func (u *Upstream) hasFallback(v4 bool) bool {
+	now := time.Now()
+	for _, ipwc := range u.IPwcs() {
+		if isIPv4(ipwc.ip) == v4 && ipwc.usable(now) && ipwc.breakerReady(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fallback : choose an IP of the other address family than ipwc, which did
+// not connect. returned IPwc must be released
+func (u *Upstream) Fallback(r *http.Request, ipwc *IPwc) (string, *IPwc, error) {
+	v4 := isIPv4(ipwc.origin.ip)
+	var exclude []*IPwc
+	for _, c := range u.IPwcs() {
+		if isIPv4(c.ip) == v4 {
+			exclude = append(exclude, &IPwc{origin: c})
+		}
+	}
+	return u.Get(r, exclude...)
+}
@@ -0,0 +1,120 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestIPv6Literal(t *testing.T) {
+	u, err := New(Config{URL: "http://[2001:db8::1]:8080/"}, zap.NewNop())
+	assert.NoError(t, err)
+	h, ipwc, err := u.Get(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:8080", h)
+	assert.Equal(t, "2001:db8::1", u.ServerName(h))
+	u.Release(ipwc)
+
+	u, err = New(Config{URL: "https://[2001:db8::1]/"}, zap.NewNop())
+	assert.NoError(t, err)
+	h, _, _ = u.Get(nil)
+	assert.Equal(t, "[2001:db8::1]", h)
+	assert.Equal(t, "[2001:db8::1]:443", u.dialAddr(u.IPwcs()[0]))
+}
+
+func TestAddressFamily(t *testing.T) {
+	members := []MemberConfig{{Host: "192.0.2.1:80"}, {Host: "[2001:db8::1]:80"}}
+	u, err := New(Config{URL: "http://dual.internal/", Members: members, AddressFamily: "ipv6"}, zap.NewNop())
+	assert.NoError(t, err)
+	assert.Len(t, u.IPwcs(), 1)
+	assert.Equal(t, "[2001:db8::1]:80", u.IPwcs()[0].host)
+
+	u, err = New(Config{URL: "http://dual.internal/", Members: members, AddressFamily: "prefer_ipv4"}, zap.NewNop())
+	assert.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		h, _, err := u.Get(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "192.0.2.1:80", h)
+	}
+	// the other family is used when preferred IPs are unusable
+	for _, ipwc := range u.IPwcs() {
+		if ipwc.ip == "192.0.2.1" {
+			ipwc.healthy.Store(false)
+		}
+	}
+	h, _, err := u.Get(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:80", h)
+
+	_, err = New(Config{URL: "http://dual.internal/", Members: members, AddressFamily: "ipv5"}, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	l4, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l4.Close()
+	l6, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback")
+	}
+	defer l6.Close()
+
+	u, err := New(Config{
+		URL:                "http://dual.internal/",
+		Members:            []MemberConfig{{Host: l4.Addr().String()}, {Host: l6.Addr().String()}},
+		AddressFamily:      "prefer_ipv4",
+		HappyEyeballsDelay: 50 * time.Millisecond,
+	}, zap.NewNop())
+	assert.NoError(t, err)
+	assert.True(t, u.HappyEyeballs())
+
+	// IPv4 path is black-holed
+	d := &net.Dialer{
+		ControlContext: func(ctx context.Context, network, address string, _ syscall.RawConn) error {
+			if network == "tcp4" {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		},
+	}
+	h, ipwc, err := u.Get(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, l4.Addr().String(), h)
+	start := time.Now()
+	_, err = u.DialContext(WithFallback(context.Background()), d, "tcp", h)
+	assert.ErrorIs(t, err, ErrFallbackDelay)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// the request goes to an IP of the other family, dialed and tracked as itself
+	fh, fipwc, err := u.Fallback(nil, ipwc)
+	assert.NoError(t, err)
+	assert.Equal(t, l6.Addr().String(), fh)
+	u.Release(ipwc)
+	conn, err := u.DialContext(WithFallback(context.Background()), d, "tcp", fh)
+	assert.NoError(t, err)
+	assert.Equal(t, l6.Addr().String(), conn.RemoteAddr().String())
+	assert.Len(t, u.conns[fh], 1)
+	assert.Len(t, u.conns[h], 0)
+	conn.Close()
+	u.Release(fipwc)
+
+	// dial of a request not falling back is not bounded
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = u.DialContext(ctx, d, "tcp", h)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrFallbackDelay)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	// disabled
+	u.fallbackDelay = -1
+	assert.False(t, u.HappyEyeballs())
+}
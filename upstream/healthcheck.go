@@ -0,0 +1,173 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// HealthCheckConfig : active health check for resolved IPs
+type HealthCheckConfig struct {
+	// http or tcp. default http
+	Type string `yaml:"type"`
+	// request path of http check. default /
+	Path string `yaml:"path"`
+	// interval between checks. default 5s
+	Interval time.Duration `yaml:"interval"`
+	// timeout of each check. default 2s
+	Timeout time.Duration `yaml:"timeout"`
+	// consecutive successes to mark an IP healthy. default 2
+	HealthyThreshold int `yaml:"healthy_threshold"`
+	// consecutive failures to mark an IP unhealthy. default 3
+	UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+	// expected status codes of http check. default any 2xx or 3xx
+	ExpectedStatus []int `yaml:"expected_status"`
+}
+
+type probeAddrKey struct{}
+
+// healthState : consecutive results. touched only by health checker
+type healthState struct {
+	successes int
+	failures  int
+}
+
+func (hc *HealthCheckConfig) setDefaults() error {
+	if hc.Type == "" {
+		hc.Type = "http"
+	}
+	if hc.Type != "http" && hc.Type != "tcp" {
+		return errors.Errorf("health check type should be http or tcp: %s", hc.Type)
+	}
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = 5 * time.Second
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = 3
+	}
+	return nil
+}
+
+func (hc *HealthCheckConfig) expected(code int) bool {
+	if len(hc.ExpectedStatus) == 0 {
+		return code >= 200 && code < 400
+	}
+	for _, c := range hc.ExpectedStatus {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *Upstream) runHealthCheck(ctx context.Context) {
+	hc := u.healthCheck
+	dialer := &net.Dialer{Timeout: hc.Timeout}
+	client := &http.Client{
+		Timeout: hc.Timeout,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{ServerName: u.tlsServerName},
+			// URL has hostname for Host header, SNI and certificate verification.
+			// connect to the IP under check
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if a, ok := ctx.Value(probeAddrKey{}).(string); ok {
+					addr = a
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.checkAll(ctx, client)
+		}
+	}
+}
+
+func (u *Upstream) checkAll(ctx context.Context, client *http.Client) {
+	ipwcs := u.IPwcs()
+	results := make([]error, len(ipwcs))
+	var wg sync.WaitGroup
+	for i, ipwc := range ipwcs {
+		wg.Add(1)
+		go func(i int, ipwc *IPwc) {
+			defer wg.Done()
+			results[i] = u.probe(ctx, client, ipwc)
+		}(i, ipwc)
+	}
+	wg.Wait()
+
+	for i, ipwc := range ipwcs {
+		hs := &ipwc.health
+		if results[i] == nil {
+			hs.failures = 0
+			hs.successes++
+			if !ipwc.healthy.Load() && hs.successes >= u.healthCheck.HealthyThreshold {
+				ipwc.healthy.Store(true)
+				u.logger.Info("upstream ip is healthy", zap.String("ip", ipwc.ip))
+			}
+			continue
+		}
+		hs.successes = 0
+		hs.failures++
+		if ipwc.healthy.Load() && hs.failures >= u.healthCheck.UnhealthyThreshold {
+			ipwc.healthy.Store(false)
+			u.logger.Warn("upstream ip is unhealthy", zap.String("ip", ipwc.ip), zap.Error(results[i]))
+		}
+	}
+}
+
+func (u *Upstream) probe(ctx context.Context, client *http.Client, ipwc *IPwc) error {
+	addr := u.dialAddr(ipwc)
+	hc := u.healthCheck
+	if hc.Type == "tcp" {
+		d := net.Dialer{Timeout: hc.Timeout}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	host := hostPort(ipwc.hostname, ipwc.port)
+	ctx = context.WithValue(ctx, probeAddrKey{}, addr)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.scheme+"://"+host+hc.Path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if !hc.expected(res.StatusCode) {
+		return errors.Errorf("unexpected status: %d", res.StatusCode)
+	}
+	return nil
+}
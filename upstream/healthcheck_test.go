@@ -0,0 +1,55 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var status int64 = http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/health", r.URL.Path)
+		w.WriteHeader(int(atomic.LoadInt64(&status)))
+	}))
+	defer ts.Close()
+
+	u, err := New(Config{
+		Name: "test",
+		URL:  ts.URL,
+		HealthCheck: &HealthCheckConfig{
+			Path:               "/health",
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 2,
+		},
+	}, zap.NewNop())
+	assert.NoError(t, err)
+	client := &http.Client{}
+	ctx := context.Background()
+
+	u.checkAll(ctx, client)
+	assert.True(t, u.IPwcs()[0].healthy.Load())
+
+	atomic.StoreInt64(&status, http.StatusServiceUnavailable)
+	u.checkAll(ctx, client)
+	assert.True(t, u.IPwcs()[0].healthy.Load())
+	u.checkAll(ctx, client)
+	assert.False(t, u.IPwcs()[0].healthy.Load())
+
+	// fail open
+	h, ipwc, err := u.Get(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, ts.Listener.Addr().String(), h)
+	u.Release(ipwc)
+
+	atomic.StoreInt64(&status, http.StatusOK)
+	u.checkAll(ctx, client)
+	assert.False(t, u.IPwcs()[0].healthy.Load())
+	u.checkAll(ctx, client)
+	assert.True(t, u.IPwcs()[0].healthy.Load())
+}
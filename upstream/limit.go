@@ -0,0 +1,191 @@
+package upstream
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrQueueFull : queue of the IP is full
+	ErrQueueFull = errors.New("upstream queue full")
+	// ErrQueueTimeout : request waited in queue of the IP longer than queue timeout
+	ErrQueueTimeout = errors.New("upstream queue timeout")
+)
+
+// ConcurrencyConfig : limit of concurrent requests by IP
+type ConcurrencyConfig struct {
+	// concurrent requests sent to an IP
+	MaxRequests int `yaml:"max_requests"`
+	// requests waiting for an IP. 0 rejects requests over max_requests at once
+	MaxQueue int `yaml:"max_queue"`
+	// how long a request waits in queue. default 1s
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	// Retry-After of 503 response for rejected requests. default 1s
+	RetryAfter time.Duration `yaml:"retry_after"`
+}
+
+func (cc *ConcurrencyConfig) setDefaults() error {
+	if cc.MaxRequests <= 0 {
+		return errors.New("max_requests of concurrency should be positive")
+	}
+	if cc.MaxQueue < 0 {
+		cc.MaxQueue = 0
+	}
+	if cc.QueueTimeout <= 0 {
+		cc.QueueTimeout = time.Second
+	}
+	if cc.RetryAfter <= 0 {
+		cc.RetryAfter = time.Second
+	}
+	return nil
+}
+
+// QueueStats : queue of an IP
+type QueueStats struct {
+	// requests waiting now
+	Queued int `json:"queued"`
+	// requests got a slot after waiting
+	Waited uint64 `json:"waited"`
+	// total time requests waited
+	WaitSeconds float64 `json:"wait_seconds"`
+	Rejected    uint64  `json:"rejected"`
+	TimedOut    uint64  `json:"timed_out"`
+}
+
+// limiter : slots of concurrent requests with FIFO queue
+type limiter struct {
+	cfg *ConcurrencyConfig
+
+	mu       sync.Mutex
+	inflight int
+	// closed when a slot is handed over
+	queue    []chan struct{}
+	waited   uint64
+	waitTime time.Duration
+	rejected uint64
+	timedOut uint64
+}
+
+func newLimiter(cfg *ConcurrencyConfig) *limiter {
+	if cfg == nil {
+		return nil
+	}
+	return &limiter{cfg: cfg}
+}
+
+// free : a slot is available without waiting
+func (l *limiter) free() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inflight < l.cfg.MaxRequests
+}
+
+// acquire : take a slot, waiting in queue up to queue timeout
+func (l *limiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.inflight < l.cfg.MaxRequests {
+		l.inflight++
+		l.mu.Unlock()
+		return nil
+	}
+	if len(l.queue) >= l.cfg.MaxQueue {
+		l.rejected++
+		l.mu.Unlock()
+		return ErrQueueFull
+	}
+	ch := make(chan struct{})
+	l.queue = append(l.queue, ch)
+	l.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(l.cfg.QueueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ch:
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		for i, c := range l.queue {
+			if c == ch {
+				l.queue = append(l.queue[:i], l.queue[i+1:]...)
+				if err == ErrQueueTimeout {
+					l.timedOut++
+				}
+				return err
+			}
+		}
+		// slot was handed over at the same time. take it
+	}
+	l.waited++
+	l.waitTime += time.Since(start)
+	return nil
+}
+
+// release : hand the slot over to the first request in queue
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.queue) > 0 {
+		close(l.queue[0])
+		l.queue = l.queue[1:]
+		return
+	}
+	l.inflight--
+}
+
+func (l *limiter) queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queue)
+}
+
+// shortestQueue : IPs with the fewest requests waiting
+func shortestQueue(candidates []*IPwc) []*IPwc {
+	min := -1
+	var filtered []*IPwc
+	for _, c := range candidates {
+		n := c.limiter.queued()
+		if min < 0 || n < min {
+			min = n
+			filtered = filtered[:0]
+		}
+		if n == min {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+func (l *limiter) stats() *QueueStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &QueueStats{
+		Queued:      len(l.queue),
+		Waited:      l.waited,
+		WaitSeconds: l.waitTime.Seconds(),
+		Rejected:    l.rejected,
+		TimedOut:    l.timedOut,
+	}
+}
+
+// RetryAfter : seconds of Retry-After for requests rejected by concurrency limit
+func (u *Upstream) RetryAfter() int {
+	if u.concurrency == nil {
+		return 1
+	}
+	s := int((u.concurrency.RetryAfter + time.Second - 1) / time.Second)
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
@@ -0,0 +1,100 @@
+package upstream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	cfg := &ConcurrencyConfig{MaxRequests: 1, MaxQueue: 1, QueueTimeout: 50 * time.Millisecond}
+	assert.NoError(t, cfg.setDefaults())
+	l := newLimiter(cfg)
+	ctx := context.Background()
+
+	assert.NoError(t, l.acquire(ctx))
+	assert.False(t, l.free())
+
+	// queued request gets the slot on release
+	got := make(chan error)
+	go func() { got <- l.acquire(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 1, l.stats().Queued)
+	assert.Equal(t, ErrQueueFull, l.acquire(ctx))
+	l.release()
+	assert.NoError(t, <-got)
+
+	// queue timeout
+	assert.Equal(t, ErrQueueTimeout, l.acquire(ctx))
+
+	// canceled while waiting
+	cctx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	assert.Equal(t, context.Canceled, l.acquire(cctx))
+
+	l.release()
+	assert.True(t, l.free())
+	st := l.stats()
+	assert.Equal(t, 0, st.Queued)
+	assert.Equal(t, uint64(1), st.Waited)
+	assert.Greater(t, st.WaitSeconds, 0.0)
+	assert.Equal(t, uint64(1), st.Rejected)
+	assert.Equal(t, uint64(1), st.TimedOut)
+}
+
+func TestGetConcurrency(t *testing.T) {
+	u := newTestUpstream(0)
+	u.concurrency = &ConcurrencyConfig{MaxRequests: 2, MaxQueue: 1, QueueTimeout: time.Second, RetryAfter: 1500 * time.Millisecond}
+	ipwcs := []*IPwc{
+		u.newIPwc(target{ip: "192.0.2.1", port: "8080", weight: 1}),
+		u.newIPwc(target{ip: "192.0.2.2", port: "8080", weight: 1}),
+	}
+	u.ipwcs.Store(&ipwcs)
+	assert.Equal(t, 2, u.RetryAfter())
+
+	held := []*IPwc{}
+	for i := 0; i < 4; i++ {
+		_, ipwc, err := u.Get(nil)
+		assert.NoError(t, err)
+		held = append(held, ipwc)
+	}
+	assert.Equal(t, int64(2), ipwcs[0].busy.Load())
+	assert.Equal(t, int64(2), ipwcs[1].busy.Load())
+
+	// all IPs are at limit. wait in the shortest queue until a request is released
+	got := make(chan *IPwc)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, ipwc, err := u.Get(nil)
+			assert.NoError(t, err)
+			got <- ipwc
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, 1, ipwcs[0].limiter.queued())
+	assert.Equal(t, 1, ipwcs[1].limiter.queued())
+	_, _, err := u.Get(nil)
+	assert.Equal(t, ErrQueueFull, err)
+
+	for _, ipwc := range held {
+		u.Release(ipwc)
+	}
+	for i := 0; i < 2; i++ {
+		u.Release(<-got)
+	}
+	for _, ipwc := range ipwcs {
+		assert.True(t, ipwc.free())
+		assert.Equal(t, int64(0), ipwc.busy.Load())
+	}
+
+	st := u.Status()
+	waited := st.IPs[0].Queue.Waited + st.IPs[1].Queue.Waited
+	rejected := st.IPs[0].Queue.Rejected + st.IPs[1].Queue.Rejected
+	assert.Equal(t, uint64(2), waited)
+	assert.Equal(t, uint64(1), rejected)
+}
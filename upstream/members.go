@@ -0,0 +1,115 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// MemberConfig : an upstream server declared without DNS.
+// "host:port" string is also accepted
+type MemberConfig struct {
+	// host:port. host is an IP or a hostname. port of URL is used if omitted
+	Host string `yaml:"host"`
+	// default 1
+	Weight int64 `yaml:"weight"`
+	// availability zone for zone aware routing
+	Zone string `yaml:"zone"`
+}
+
+// UnmarshalYAML : accept "host:port" as well as a mapping
+func (m *MemberConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&m.Host)
+	}
+	type plain MemberConfig
+	return value.Decode((*plain)(m))
+}
+
+// loadMembers : read members from JSON or YAML file
+func loadMembers(path string) ([]MemberConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read members file")
+	}
+	var members []MemberConfig
+	if err := yaml.Unmarshal(b, &members); err != nil {
+		return nil, errors.Wrap(err, "could not parse members file")
+	}
+	return members, nil
+}
+
+// lookupMembers : resolve members. IPs are used as is
+func (u *Upstream) lookupMembers(ctx context.Context, members []MemberConfig) ([]target, time.Duration, error) {
+	var targets []target
+	var ttl time.Duration
+	var lastErr error
+	for _, m := range members {
+		host, port, err := net.SplitHostPort(m.Host)
+		if err != nil {
+			host = m.Host
+			port = u.port
+		}
+		if host == "" {
+			lastErr = errors.Errorf("member has no host: %q", m.Host)
+			u.logger.Warn("invalid member", zap.Error(lastErr))
+			continue
+		}
+		ips, ipTTL, err := u.resolver.LookupIP(ctx, host)
+		if err != nil {
+			u.logger.Warn("failed resolv member", zap.String("member", m.Host), zap.Error(err))
+			lastErr = err
+			continue
+		}
+		if ipTTL > 0 && (ttl == 0 || ipTTL < ttl) {
+			ttl = ipTTL
+		}
+		hostname := host
+		if net.ParseIP(host) != nil {
+			// TLS and health check use hostname of URL
+			hostname = u.host
+		}
+		for _, ip := range ips {
+			targets = append(targets, target{
+				ip:       ip.String(),
+				port:     port,
+				hostname: hostname,
+				weight:   m.Weight,
+				zone:     m.Zone,
+			})
+		}
+	}
+	if len(targets) == 0 && lastErr != nil {
+		return nil, 0, errors.Wrap(lastErr, "could not resolv any member")
+	}
+	return targets, ttl, nil
+}
+
+// lookupMembersFile : read members file and resolve its members
+func (u *Upstream) lookupMembersFile(ctx context.Context) ([]target, time.Duration, error) {
+	members, err := loadMembers(u.membersFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	return u.lookupMembers(ctx, members)
+}
+
+// watchMembersFile : refresh IPs when members file changes
+func (u *Upstream) watchMembersFile(ctx context.Context) {
+	notify := func() {
+		select {
+		case u.reload <- struct{}{}:
+		default:
+		}
+	}
+	if err := watchFile(ctx, u.membersFile, notify); err != nil {
+		u.logger.Warn("could not watch members file. fallback to polling",
+			zap.String("file", u.membersFile), zap.Error(err))
+		go pollFile(ctx, u.membersFile, filePollInterval, notify)
+	}
+}
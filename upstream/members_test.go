@@ -0,0 +1,103 @@
+package upstream
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+func TestStaticMembers(t *testing.T) {
+	cfg := Config{}
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+name: legacy
+url: http://legacy.internal:8080/
+members:
+  - 192.0.2.1
+  - host: 192.0.2.2:9000
+    weight: 3
+`), &cfg))
+	u, err := New(cfg, zap.NewNop())
+	assert.NoError(t, err)
+
+	ipwcs := u.IPwcs()
+	assert.Len(t, ipwcs, 2)
+	byHost := map[string]*IPwc{}
+	for _, ipwc := range ipwcs {
+		byHost[ipwc.host] = ipwc
+	}
+	assert.Equal(t, int64(1), byHost["192.0.2.1:8080"].weight)
+	assert.Equal(t, int64(3), byHost["192.0.2.2:9000"].weight)
+	assert.Equal(t, "legacy.internal", byHost["192.0.2.2:9000"].hostname)
+
+	_, err = New(Config{URL: "srv+http://_api._tcp.example/", Members: cfg.Members}, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func TestMembersFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "members.json")
+	write := func(content string) {
+		tmp := filepath.Join(dir, "members.tmp")
+		assert.NoError(t, os.WriteFile(tmp, []byte(content), 0644))
+		// replaced by rename as deploy systems do
+		assert.NoError(t, os.Rename(tmp, path))
+	}
+	write(`[{"host": "192.0.2.1:8080", "weight": 2}]`)
+
+	u, err := New(Config{Name: "legacy", URL: "http://legacy.internal/", MembersFile: path}, zap.NewNop())
+	assert.NoError(t, err)
+	assert.Len(t, u.IPwcs(), 1)
+	assert.Equal(t, int64(2), u.IPwcs()[0].weight)
+
+	write(`["192.0.2.1:8080", "192.0.2.2:8080"]`)
+	assert.Eventually(t, func() bool {
+		return len(u.IPwcs()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	weights := func() map[string]int64 {
+		w := map[string]int64{}
+		for _, ipwc := range u.IPwcs() {
+			w[ipwc.host] = ipwc.weight
+		}
+		return w
+	}
+	assert.Equal(t, map[string]int64{"192.0.2.1:8080": 1, "192.0.2.2:8080": 1}, weights())
+
+	// weight change of a kept IP is applied
+	write(`[{"host": "192.0.2.1:8080", "weight": 10}, "192.0.2.2:8080"]`)
+	assert.Eventually(t, func() bool {
+		return weights()["192.0.2.1:8080"] == 10
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// broken file keeps current members
+	write(`{`)
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, u.IPwcs(), 2)
+	assert.NotEmpty(t, u.Status().LastError)
+}
+
+func TestPollFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "members.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("- 192.0.2.1\n"), 0644))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notified := make(chan struct{}, 1)
+	go pollFile(ctx, path, 10*time.Millisecond, func() {
+		select {
+		case notified <- struct{}{}:
+		default:
+		}
+	})
+	time.Sleep(30 * time.Millisecond)
+	assert.NoError(t, os.WriteFile(path, []byte("- 192.0.2.1\n- 192.0.2.2\n"), 0644))
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("change was not noticed")
+	}
+}
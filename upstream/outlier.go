@@ -0,0 +1,162 @@
+package upstream
+
+import (
+	"time"
+
+	"github.com/kazeburo/chocon/breaker"
+	"go.uber.org/zap"
+)
+
+// OutlierConfig : passive ejection of IPs by proxied request failures
+type OutlierConfig struct {
+	// consecutive failures to eject an IP. default 5, -1 disables
+	ConsecutiveErrors int `yaml:"consecutive_errors"`
+	// failure rate (0.0-1.0) in interval to eject an IP. 0 disables
+	ErrorRate float64 `yaml:"error_rate"`
+	// minimum requests in interval to evaluate error_rate. default 10
+	MinRequests int `yaml:"min_requests"`
+	// window of error_rate. default 10s
+	Interval time.Duration `yaml:"interval"`
+	// ejection period, multiplied by number of times the IP was ejected. default 30s
+	BaseEjectionTime time.Duration `yaml:"base_ejection_time"`
+	// upper limit of ejection period. default 300s
+	MaxEjectionTime time.Duration `yaml:"max_ejection_time"`
+	// maximum percentage of ejected IPs. at least one IP can be ejected
+	// unless it is the last one. default 10
+	MaxEjectionPercent int `yaml:"max_ejection_percent"`
+}
+
+// outlierState : guarded by IPwc.mu
+type outlierState struct {
+	consecutive  int
+	requests     int
+	errors       int
+	windowStart  time.Time
+	ejections    int
+	ejectedUntil time.Time
+}
+
+func (oc *OutlierConfig) setDefaults() {
+	if oc.ConsecutiveErrors == 0 {
+		oc.ConsecutiveErrors = 5
+	}
+	if oc.MinRequests <= 0 {
+		oc.MinRequests = 10
+	}
+	if oc.Interval <= 0 {
+		oc.Interval = 10 * time.Second
+	}
+	if oc.BaseEjectionTime <= 0 {
+		oc.BaseEjectionTime = 30 * time.Second
+	}
+	if oc.MaxEjectionTime <= 0 {
+		oc.MaxEjectionTime = 300 * time.Second
+	}
+	if oc.MaxEjectionPercent <= 0 {
+		oc.MaxEjectionPercent = 10
+	}
+}
+
+// Report : feedback result of proxied request. err should be set only when
+// the request failed by upstream (dial error, timeout)
+func (u *Upstream) Report(o *IPwc, err error) {
+	if o == nil || o.origin == nil {
+		return
+	}
+	if err == nil {
+		o.outcome = breaker.Success
+	} else {
+		o.outcome = breaker.Failure
+	}
+	if u.outlier == nil {
+		return
+	}
+	ipwc := o.origin
+	ipwc.mu.Lock()
+	defer ipwc.mu.Unlock()
+
+	now := time.Now()
+	st := &ipwc.outlier
+	if now.Sub(st.windowStart) > u.outlier.Interval {
+		st.windowStart = now
+		st.requests = 0
+		st.errors = 0
+	}
+	st.requests++
+	if err == nil {
+		st.consecutive = 0
+		return
+	}
+	st.errors++
+	st.consecutive++
+
+	if now.Before(st.ejectedUntil) {
+		return
+	}
+	oc := u.outlier
+	reason := ""
+	if oc.ConsecutiveErrors > 0 && st.consecutive >= oc.ConsecutiveErrors {
+		reason = "consecutive_errors"
+	} else if oc.ErrorRate > 0 && st.requests >= oc.MinRequests &&
+		float64(st.errors)/float64(st.requests) >= oc.ErrorRate {
+		reason = "error_rate"
+	}
+	if reason == "" {
+		return
+	}
+
+	// forget past ejections if the IP has been fine long enough
+	ejections := st.ejections
+	if !st.ejectedUntil.IsZero() && now.Sub(st.ejectedUntil) > oc.MaxEjectionTime {
+		ejections = 0
+	}
+	ejections++
+	d := oc.BaseEjectionTime * time.Duration(ejections)
+	if d > oc.MaxEjectionTime {
+		d = oc.MaxEjectionTime
+	}
+	if !u.eject(ipwc, now, d) {
+		return
+	}
+	st.ejections = ejections
+	st.ejectedUntil = now.Add(d)
+	u.logger.Warn("eject upstream ip",
+		zap.String("ip", ipwc.ip),
+		zap.String("reason", reason),
+		zap.Int("consecutive_errors", st.consecutive),
+		zap.Int("errors", st.errors),
+		zap.Int("requests", st.requests),
+		zap.Duration("duration", d),
+		zap.Error(err),
+	)
+	st.consecutive = 0
+	st.requests = 0
+	st.errors = 0
+	st.windowStart = now
+}
+
+// eject : eject the IP for d unless too many IPs are ejected
+func (u *Upstream) eject(target *IPwc, now time.Time, d time.Duration) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ipwcs := u.IPwcs()
+	total := len(ipwcs)
+	ejected := 0
+	for _, ipwc := range ipwcs {
+		if now.UnixNano() < ipwc.ejectedUntil.Load() {
+			ejected++
+		}
+	}
+	if ejected+1 >= total {
+		return false
+	}
+	max := total * u.outlier.MaxEjectionPercent / 100
+	if max < 1 {
+		max = 1
+	}
+	if ejected >= max {
+		return false
+	}
+	target.ejectedUntil.Store(now.Add(d).UnixNano())
+	return true
+}
@@ -0,0 +1,59 @@
+package upstream
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestOutlierEjection(t *testing.T) {
+	oc := &OutlierConfig{ConsecutiveErrors: 3, MaxEjectionPercent: 50}
+	oc.setDefaults()
+	u := &Upstream{
+		balancer: &leastBusy{},
+		outlier:  oc,
+		logger:   zap.NewNop(),
+	}
+	ipwcs := []*IPwc{
+		testIPwc("192.0.2.1", 1),
+		testIPwc("192.0.2.2", 1),
+		testIPwc("192.0.2.3", 1),
+		testIPwc("192.0.2.4", 1),
+	}
+	u.ipwcs.Store(&ipwcs)
+	report := func(i int, err error) {
+		u.Report(&IPwc{ip: ipwcs[i].ip, origin: ipwcs[i]}, err)
+	}
+	dialErr := errors.New("connection refused")
+
+	for i := 0; i < 2; i++ {
+		report(0, dialErr)
+	}
+	report(0, nil)
+	report(0, dialErr)
+	assert.True(t, ipwcs[0].usable(time.Now()))
+
+	for i := 0; i < 2; i++ {
+		report(0, dialErr)
+	}
+	assert.False(t, ipwcs[0].usable(time.Now()))
+	assert.WithinDuration(t, time.Now().Add(30*time.Second), time.Unix(0, ipwcs[0].ejectedUntil.Load()), time.Second)
+
+	for _, i := range []int{1, 2} {
+		for j := 0; j < 3; j++ {
+			report(i, dialErr)
+		}
+	}
+	// max_ejection_percent 50 of 4 IPs
+	assert.False(t, ipwcs[1].usable(time.Now()))
+	assert.True(t, ipwcs[2].usable(time.Now()))
+
+	for i := 0; i < 4; i++ {
+		_, ipwc, err := u.Get(nil)
+		assert.NoError(t, err)
+		assert.NotContains(t, []string{"192.0.2.1", "192.0.2.2"}, ipwc.ip)
+	}
+}
@@ -0,0 +1,66 @@
+package upstream
+
+import (
+	"net/url"
+	"strings"
+)
+
+// RewriteURL : strip prefix from request path, then join it to the path of
+// upstream URL and merge query of upstream URL
+func (u *Upstream) RewriteURL(pu *url.URL) {
+	if u.stripPrefix != "" {
+		if p, ok := stripPathPrefix(pu.Path, u.stripPrefix); ok {
+			if rp, ok := stripPathPrefix(pu.RawPath, u.stripPrefix); ok && pu.RawPath != "" {
+				pu.RawPath = rp
+			} else {
+				pu.RawPath = ""
+			}
+			pu.Path = p
+		}
+	}
+	if u.basePath != "" && u.basePath != "/" {
+		path := joinPath(u.basePath, pu.Path)
+		if u.baseRawPath != "" || pu.RawPath != "" {
+			base := u.baseRawPath
+			if base == "" {
+				base = u.basePath
+			}
+			pu.RawPath = joinPath(base, pu.EscapedPath())
+		}
+		pu.Path = path
+	}
+	if u.rawQuery != "" {
+		if pu.RawQuery == "" {
+			pu.RawQuery = u.rawQuery
+		} else {
+			pu.RawQuery = u.rawQuery + "&" + pu.RawQuery
+		}
+	}
+}
+
+// stripPathPrefix : remove prefix at a segment boundary
+func stripPathPrefix(path, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(path, prefix) {
+		return path, false
+	}
+	rest := path[len(prefix):]
+	if rest == "" {
+		return "/", true
+	}
+	if rest[0] != '/' {
+		return path, false
+	}
+	return rest, true
+}
+
+// joinPath : join with a single slash. trailing slash of path is kept
+func joinPath(base, path string) string {
+	if path == "" || path == "/" {
+		if strings.HasSuffix(base, "/") {
+			return base
+		}
+		return base + path
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
@@ -0,0 +1,40 @@
+package upstream
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRewriteURL(t *testing.T) {
+	cases := []struct {
+		url, strip, req, want string
+	}{
+		{"http://192.0.2.1/", "", "/foo?a=1", "/foo?a=1"},
+		{"http://192.0.2.1", "", "/foo", "/foo"},
+		{"http://192.0.2.1/api/v2/", "", "/foo", "/api/v2/foo"},
+		{"http://192.0.2.1/api/v2", "", "/foo/", "/api/v2/foo/"},
+		{"http://192.0.2.1/api/v2/", "", "/", "/api/v2/"},
+		{"http://192.0.2.1/api/v2?key=x", "", "/foo?a=1", "/api/v2/foo?key=x&a=1"},
+		{"http://192.0.2.1/api/v2?key=x", "", "/foo", "/api/v2/foo?key=x"},
+		{"http://192.0.2.1/api/", "", "/a%2Fb/c", "/api/a%2Fb/c"},
+		{"http://192.0.2.1/a%2Fb/", "", "/c", "/a%2Fb/c"},
+		{"http://192.0.2.1/", "/app", "/app/foo", "/foo"},
+		{"http://192.0.2.1/", "/app/", "/app", "/"},
+		{"http://192.0.2.1/", "/app", "/application", "/application"},
+		{"http://192.0.2.1/api/", "/app", "/app/x%2Fy", "/api/x%2Fy"},
+	}
+	for _, c := range cases {
+		u, err := New(Config{URL: c.url, StripPrefix: c.strip}, zap.NewNop())
+		assert.NoError(t, err)
+		pu, err := url.Parse("http://client" + c.req)
+		assert.NoError(t, err)
+		u.RewriteURL(pu)
+		assert.Equal(t, "http://client"+c.want, pu.String(), c)
+	}
+
+	_, err := New(Config{URL: "http://192.0.2.1/", StripPrefix: "app"}, zap.NewNop())
+	assert.Error(t, err)
+}
@@ -0,0 +1,69 @@
+package upstream
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryConfig : retry failed requests on another IP
+type RetryConfig struct {
+	// maximum number of retries. 0 disables
+	Attempts int `yaml:"attempts"`
+	// error classes to retry: connect_error, timeout. default [connect_error]
+	On []string `yaml:"on"`
+	// response status codes to retry. e.g. [502, 503]
+	Status []int `yaml:"status"`
+	// time budget of a request. no retry starts after it. 0 means no limit
+	Budget time.Duration `yaml:"budget"`
+	// request body up to this size is buffered to be replayed. default 64KiB
+	MaxBodySize int64 `yaml:"max_body_size"`
+
+	onConnectError bool
+	onTimeout      bool
+}
+
+func (rc *RetryConfig) setDefaults() error {
+	if len(rc.On) == 0 {
+		rc.On = []string{"connect_error"}
+	}
+	for _, on := range rc.On {
+		switch on {
+		case "connect_error":
+			rc.onConnectError = true
+		case "timeout":
+			rc.onTimeout = true
+		default:
+			return errors.Errorf("retry on should be connect_error or timeout: %s", on)
+		}
+	}
+	if rc.MaxBodySize <= 0 {
+		rc.MaxBodySize = 64 * 1024
+	}
+	return nil
+}
+
+// OnConnectError : retry when connecting to upstream failed
+func (rc *RetryConfig) OnConnectError() bool {
+	return rc.onConnectError
+}
+
+// OnTimeout : retry when upstream timed out
+func (rc *RetryConfig) OnTimeout() bool {
+	return rc.onTimeout
+}
+
+// OnStatus : retry on response status code
+func (rc *RetryConfig) OnStatus(code int) bool {
+	for _, c := range rc.Status {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Retry : retry policy of upstream. nil if disabled
+func (u *Upstream) Retry() *RetryConfig {
+	return u.retry
+}
@@ -0,0 +1,41 @@
+package upstream
+
+import (
+	"time"
+)
+
+// weightScale : fixed point of effective weight
+const weightScale = 1000
+
+// SlowStartConfig : ramp up weight of newly resolved IPs
+type SlowStartConfig struct {
+	// period in which weight ramps up linearly. 0 disables
+	Window time.Duration `yaml:"window"`
+	// weight at start of window in percent of full weight. default 10
+	MinWeightPercent int `yaml:"min_weight_percent"`
+}
+
+func (sc *SlowStartConfig) setDefaults() {
+	if sc.MinWeightPercent <= 0 || sc.MinWeightPercent > 100 {
+		sc.MinWeightPercent = 10
+	}
+}
+
+// effectiveWeight : weight ramped up in slow start window, scaled by weightScale
+func (ipwc *IPwc) effectiveWeight() int64 {
+	w := ipwc.weight * weightScale
+	if ipwc.slowStart == nil || ipwc.added.IsZero() {
+		return w
+	}
+	elapsed := time.Since(ipwc.added)
+	if elapsed >= ipwc.slowStart.Window {
+		return w
+	}
+	// linear from min weight at start to full weight at end of window
+	min := float64(ipwc.slowStart.MinWeightPercent) / 100
+	f := min + (1-min)*float64(elapsed)/float64(ipwc.slowStart.Window)
+	if ew := int64(float64(w) * f); ew > 0 {
+		return ew
+	}
+	return 1
+}
@@ -0,0 +1,43 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEffectiveWeight(t *testing.T) {
+	sc := &SlowStartConfig{Window: 100 * time.Second, MinWeightPercent: 10}
+	ipwc := testIPwc("192.0.2.1", 2)
+	assert.Equal(t, int64(2*weightScale), ipwc.effectiveWeight())
+
+	ipwc.slowStart = sc
+	ipwc.added = time.Now()
+	assert.Equal(t, int64(2*weightScale/10), ipwc.effectiveWeight())
+	// 10% + 90% * elapsed / window
+	ipwc.added = time.Now().Add(-10 * time.Second)
+	assert.InDelta(t, 2*weightScale*19/100, ipwc.effectiveWeight(), 2)
+	ipwc.added = time.Now().Add(-50 * time.Second)
+	assert.InDelta(t, 2*weightScale*55/100, ipwc.effectiveWeight(), 2)
+	ipwc.added = time.Now().Add(-100 * time.Second)
+	assert.Equal(t, int64(2*weightScale), ipwc.effectiveWeight())
+}
+
+func TestSlowStartLeastBusy(t *testing.T) {
+	u := newTestUpstream(3)
+	ipwcs := u.IPwcs()
+	// 192.0.2.3 is just added
+	ipwcs[2].slowStart = &SlowStartConfig{Window: time.Minute, MinWeightPercent: 10}
+	ipwcs[2].added = time.Now()
+
+	seen := map[string]int{}
+	for i := 0; i < 42; i++ {
+		_, ipwc, err := u.Get(nil)
+		assert.NoError(t, err)
+		seen[ipwc.ip]++
+	}
+	// cold IP gets about 1/10 of others
+	assert.InDelta(t, 2, seen["192.0.2.3"], 1)
+	assert.InDelta(t, 20, seen["192.0.2.1"], 1)
+}
@@ -0,0 +1,47 @@
+package upstream
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// lookupSRV : resolve SRV records and IPs of their targets.
+// returns the lowest known TTL
+func (u *Upstream) lookupSRV(ctx context.Context) ([]target, time.Duration, error) {
+	srvs, ttl, err := u.resolver.LookupSRV(ctx, u.host)
+	if err != nil {
+		return nil, 0, err
+	}
+	var targets []target
+	var lastErr error
+	for _, srv := range srvs {
+		hostname := strings.TrimSuffix(srv.Target, ".")
+		ips, ipTTL, err := u.resolver.LookupIP(ctx, hostname)
+		if err != nil {
+			u.logger.Warn("failed resolv srv target", zap.String("target", hostname), zap.Error(err))
+			lastErr = err
+			continue
+		}
+		if ipTTL > 0 && (ttl == 0 || ipTTL < ttl) {
+			ttl = ipTTL
+		}
+		for _, ip := range ips {
+			targets = append(targets, target{
+				ip:       ip.String(),
+				port:     strconv.Itoa(int(srv.Port)),
+				hostname: hostname,
+				priority: srv.Priority,
+				weight:   int64(srv.Weight),
+			})
+		}
+	}
+	if len(targets) == 0 && lastErr != nil {
+		return nil, 0, errors.Wrap(lastErr, "could not resolv any srv target")
+	}
+	return targets, ttl, nil
+}
@@ -0,0 +1,110 @@
+package upstream
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// StaleConfig : keep serving last good addresses when resolution fails
+type StaleConfig struct {
+	// how long last good addresses are served after resolution started
+	// failing. 0 means forever
+	MaxStale time.Duration `yaml:"max_stale"`
+	// answers shrinking the pool below this percentage of its current size
+	// are ignored until max_stale. 0 disables. requires max_stale
+	MinShrinkPercent int `yaml:"min_shrink_percent"`
+}
+
+func (sc *StaleConfig) validate() error {
+	if sc.MinShrinkPercent < 0 || sc.MinShrinkPercent > 100 {
+		return errors.Errorf("stale min_shrink_percent should be between 0 and 100: %d", sc.MinShrinkPercent)
+	}
+	if sc.MinShrinkPercent > 0 && sc.MaxStale <= 0 {
+		// a pool would never shrink
+		return errors.New("stale min_shrink_percent requires max_stale")
+	}
+	return nil
+}
+
+const (
+	staleReasonError  = "error"
+	staleReasonEmpty  = "empty"
+	staleReasonShrink = "shrink"
+)
+
+// checkAnswer : decide whether resolved targets replace the pool.
+// returns non-nil error if the current pool is kept. must be called with u.mu held
+func (u *Upstream) checkAnswer(targets []target, err error, now time.Time) error {
+	current := len(u.IPwcs())
+	reason := ""
+	switch {
+	case err != nil:
+		reason = staleReasonError
+	case len(targets) == 0:
+		reason = staleReasonEmpty
+		err = errors.New("empty answer")
+	case u.stale.MinShrinkPercent > 0 && len(targets)*100 < current*u.stale.MinShrinkPercent:
+		reason = staleReasonShrink
+		err = errors.Errorf("answer shrinks pool from %d to %d", current, len(targets))
+	}
+
+	if err == nil {
+		if !u.staleSince.IsZero() {
+			u.logger.Info("upstream addresses are fresh again",
+				zap.Duration("stale", now.Sub(u.staleSince)))
+		}
+		u.staleSince = time.Time{}
+		u.staleReason = ""
+		u.lastError = ""
+		u.lastRefresh = now
+		return nil
+	}
+
+	u.lastError = err.Error()
+	if current == 0 {
+		return err
+	}
+	if u.staleSince.IsZero() {
+		u.staleSince = now
+	}
+	u.staleReason = reason
+	stale := now.Sub(u.staleSince)
+	if u.stale.MaxStale <= 0 || stale <= u.stale.MaxStale {
+		u.logger.Warn("serving stale upstream addresses",
+			zap.String("reason", reason),
+			zap.Duration("stale", stale),
+			zap.Int("ips", current),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	if reason == staleReasonShrink {
+		// the smaller answer lasted longer than max_stale. accept it
+		u.logger.Warn("accept shrunk upstream addresses after max stale",
+			zap.Duration("stale", stale),
+			zap.Int("ips", len(targets)),
+		)
+		u.staleSince = time.Time{}
+		u.staleReason = ""
+		u.lastError = ""
+		u.lastRefresh = now
+		return nil
+	}
+	u.logger.Error("drop stale upstream addresses",
+		zap.String("reason", reason),
+		zap.Duration("stale", stale),
+		zap.Error(err),
+	)
+	old := u.IPwcs()
+	u.csum = ""
+	u.ipwcs.Store(&[]*IPwc{})
+	u.staleSince = time.Time{}
+	u.staleReason = ""
+	for _, ipwc := range old {
+		u.drain(ipwc)
+	}
+	return err
+}
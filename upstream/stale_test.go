@@ -0,0 +1,58 @@
+package upstream
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestCheckAnswer(t *testing.T) {
+	u := newTestUpstream(4)
+	u.stale = StaleConfig{MaxStale: time.Minute, MinShrinkPercent: 50}
+	now := time.Now()
+	one := []target{{ip: "192.0.2.1"}}
+
+	assert.Error(t, u.checkAnswer(nil, errors.New("timeout"), now))
+	assert.Equal(t, "error", u.Status().StaleReason)
+	assert.Error(t, u.checkAnswer(nil, nil, now.Add(10*time.Second)))
+	st := u.Status()
+	assert.True(t, st.Stale)
+	assert.Equal(t, "empty", st.StaleReason)
+	assert.Equal(t, now, *st.StaleSince)
+	assert.Len(t, st.IPs, 4)
+
+	// shrink guard
+	assert.Error(t, u.checkAnswer(one, nil, now.Add(20*time.Second)))
+	assert.Equal(t, "shrink", u.Status().StaleReason)
+	// accepted after max_stale
+	assert.NoError(t, u.checkAnswer(one, nil, now.Add(2*time.Minute)))
+	assert.False(t, u.Status().Stale)
+
+	// stale addresses are dropped after max_stale, closing their connections
+	client, server := net.Pipe()
+	defer server.Close()
+	u.track(u.dialAddr(u.IPwcs()[0]), client)
+	assert.Error(t, u.checkAnswer(nil, errors.New("timeout"), now))
+	assert.Error(t, u.checkAnswer(nil, errors.New("timeout"), now.Add(2*time.Minute)))
+	assert.Len(t, u.IPwcs(), 0)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := server.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Len(t, u.conns, 0)
+	_, _, err = u.Get(nil)
+	assert.Error(t, err)
+}
+
+func TestStaleConfig(t *testing.T) {
+	_, err := New(Config{URL: "http://192.0.2.1/", Stale: StaleConfig{MinShrinkPercent: 50}}, zap.NewNop())
+	assert.Error(t, err, "shrink would never be accepted")
+	_, err = New(Config{URL: "http://192.0.2.1/", Stale: StaleConfig{MaxStale: time.Minute, MinShrinkPercent: 150}}, zap.NewNop())
+	assert.Error(t, err)
+	_, err = New(Config{URL: "http://192.0.2.1/", Stale: StaleConfig{MaxStale: time.Minute, MinShrinkPercent: 50}}, zap.NewNop())
+	assert.NoError(t, err)
+}
@@ -0,0 +1,105 @@
+package upstream
+
+import (
+	"time"
+
+	"github.com/kazeburo/chocon/breaker"
+)
+
+// Status : state of upstream pool. Active is the pool serving requests
+// of this pool, which differs from Name while failed over to Backup
+type Status struct {
+	Name        string      `json:"name"`
+	Scheme      string      `json:"scheme"`
+	Host        string      `json:"host"`
+	Version     uint64      `json:"version"`
+	LastRefresh time.Time   `json:"last_refresh"`
+	LastError   string      `json:"last_error,omitempty"`
+	Stale       bool        `json:"stale"`
+	StaleSince  *time.Time  `json:"stale_since,omitempty"`
+	StaleReason string      `json:"stale_reason,omitempty"`
+	Backup      string      `json:"backup,omitempty"`
+	Active      string      `json:"active,omitempty"`
+	LocalZone   string      `json:"local_zone,omitempty"`
+	Spillover   bool        `json:"spillover,omitempty"`
+	IPs         []*IPStatus `json:"ips"`
+}
+
+// IPStatus : state of an IP in upstream pool
+type IPStatus struct {
+	Host     string `json:"host"`
+	Hostname string `json:"hostname"`
+	Zone     string `json:"zone,omitempty"`
+	// record version the IP first resolved
+	Version  uint64 `json:"version"`
+	Priority uint16 `json:"priority"`
+	Weight   int64  `json:"weight"`
+	// weight in slow start
+	EffectiveWeight float64 `json:"effective_weight"`
+	Busy            int64   `json:"busy"`
+	// requests sent to the IP
+	Requests     uint64         `json:"requests"`
+	Healthy      bool           `json:"healthy"`
+	EjectedUntil *time.Time     `json:"ejected_until,omitempty"`
+	Breaker      *breaker.Stats `json:"breaker,omitempty"`
+	Queue        *QueueStats    `json:"queue,omitempty"`
+}
+
+// Status : current state of upstream pool
+func (u *Upstream) Status() *Status {
+	u.mu.Lock()
+	st := &Status{
+		Name:        u.name,
+		Scheme:      u.scheme,
+		Host:        u.host,
+		Version:     u.version,
+		LastRefresh: u.lastRefresh,
+		LastError:   u.lastError,
+		Stale:       !u.staleSince.IsZero(),
+		StaleReason: u.staleReason,
+	}
+	if st.Stale {
+		since := u.staleSince
+		st.StaleSince = &since
+	}
+	u.mu.Unlock()
+	if u.backup != nil {
+		st.Backup = u.backup.name
+		st.Active = u.Active().name
+	}
+	if u.zone != nil {
+		st.LocalZone = u.zone.cfg.Local
+		st.Spillover = u.spillover.Load()
+	}
+
+	now := time.Now()
+	ipwcs := u.IPwcs()
+	st.IPs = make([]*IPStatus, len(ipwcs))
+	for i, ipwc := range ipwcs {
+		is := &IPStatus{
+			Host:            ipwc.host,
+			Hostname:        ipwc.hostname,
+			Zone:            ipwc.zone,
+			Version:         ipwc.version,
+			Priority:        ipwc.priority,
+			Weight:          ipwc.weight,
+			EffectiveWeight: float64(ipwc.effectiveWeight()) / weightScale,
+			Busy:            ipwc.busy.Load(),
+			Requests:        ipwc.requests.Load(),
+			Healthy:         ipwc.healthy.Load(),
+		}
+		if until := ipwc.ejectedUntil.Load(); now.UnixNano() < until {
+			t := time.Unix(0, until)
+			is.EjectedUntil = &t
+		}
+		if ipwc.breaker != nil {
+			bs := ipwc.breaker.Stats()
+			is.Breaker = &bs
+		}
+		if ipwc.limiter != nil {
+			is.Queue = ipwc.limiter.stats()
+		}
+		st.IPs[i] = is
+	}
+	return st
+}
@@ -0,0 +1,44 @@
+package upstream
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatus(t *testing.T) {
+	u := newTestUpstream(2)
+	u.name = "api"
+	u.host = "api.internal"
+	ipwcs := u.IPwcs()
+	ipwcs[1].healthy.Store(false)
+	ipwcs[1].ejectedUntil.Store(time.Now().Add(time.Minute).UnixNano())
+
+	var held []*IPwc
+	for i := 0; i < 3; i++ {
+		_, ipwc, err := u.Get(nil)
+		assert.NoError(t, err)
+		held = append(held, ipwc)
+	}
+	u.Release(held[0])
+
+	st := u.Status()
+	assert.Equal(t, "api", st.Name)
+	assert.Len(t, st.IPs, 2)
+	assert.Equal(t, "192.0.2.1:8080", st.IPs[0].Host)
+	assert.Equal(t, int64(2), st.IPs[0].Busy)
+	assert.Equal(t, uint64(3), st.IPs[0].Requests)
+	assert.True(t, st.IPs[0].Healthy)
+	assert.Nil(t, st.IPs[0].EjectedUntil)
+	assert.Equal(t, float64(1), st.IPs[0].EffectiveWeight)
+	assert.False(t, st.IPs[1].Healthy)
+	assert.NotNil(t, st.IPs[1].EjectedUntil)
+	assert.Equal(t, uint64(0), st.IPs[1].Requests)
+
+	b, err := json.Marshal(st)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"busy":2,"requests":3,"healthy":true`)
+	assert.NotContains(t, string(b), `"breaker"`)
+}
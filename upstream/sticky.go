@@ -0,0 +1,134 @@
+package upstream
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StickyConfig : cookie affinity of clients to IPs
+type StickyConfig struct {
+	// cookie name. default chocon_affinity_<upstream name>
+	Cookie string `yaml:"cookie"`
+	// key to sign cookie. share it among chocon instances behind a load balancer.
+	// a random key is generated at startup if empty
+	Secret string `yaml:"secret"`
+	// Max-Age of cookie. session cookie if 0
+	TTL time.Duration `yaml:"ttl"`
+	// Path of cookie. default /
+	Path   string `yaml:"path"`
+	Secure bool   `yaml:"secure"`
+}
+
+// setDefaults : name is upstream name, so that pools on the same host do
+// not overwrite cookies of each other by default
+func (sc *StickyConfig) setDefaults(name string) error {
+	if sc.Cookie == "" {
+		sc.Cookie = "chocon_affinity_" + cookieToken(name)
+	}
+	if sc.Path == "" {
+		sc.Path = "/"
+	}
+	if sc.Secret == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return errors.Wrap(err, "could not generate sticky secret")
+		}
+		sc.Secret = string(key)
+	}
+	return nil
+}
+
+// cookieToken : s with characters not allowed in cookie name replaced by _
+func cookieToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '.', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// sign : cookie value naming host
+func (sc *StickyConfig) sign(name, host string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(host)) + "." +
+		base64.RawURLEncoding.EncodeToString(sc.mac(name, host))
+}
+
+// verify : host named by cookie value. false if the value is not signed by us
+func (sc *StickyConfig) verify(name, value string) (string, bool) {
+	h, s, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", false
+	}
+	host, err := base64.RawURLEncoding.DecodeString(h)
+	if err != nil {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(sig, sc.mac(name, string(host))) {
+		return "", false
+	}
+	return string(host), true
+}
+
+// mac : signature bound to upstream name, so that a cookie of a pool
+// is not honored by another pool
+func (sc *StickyConfig) mac(name, host string) []byte {
+	m := hmac.New(sha256.New, []byte(sc.Secret))
+	m.Write([]byte(name))
+	m.Write([]byte{0})
+	m.Write([]byte(host))
+	return m.Sum(nil)[:16]
+}
+
+// pinned : IP named by affinity cookie of r. nil if none
+func (u *Upstream) pinned(r *http.Request, ipwcs []*IPwc) *IPwc {
+	if u.sticky == nil || r == nil {
+		return nil
+	}
+	c, err := r.Cookie(u.sticky.Cookie)
+	if err != nil {
+		return nil
+	}
+	host, ok := u.sticky.verify(u.name, c.Value)
+	if !ok {
+		return nil
+	}
+	for _, ipwc := range ipwcs {
+		if ipwc.host == host {
+			return ipwc
+		}
+	}
+	return nil
+}
+
+// AffinityCookie : cookie pinning client to the IP of ipwc.
+// nil if sticky is disabled or the request was already pinned to the IP
+func (u *Upstream) AffinityCookie(ipwc *IPwc) *http.Cookie {
+	if u.sticky == nil || ipwc == nil || ipwc.origin == nil || ipwc.pinned {
+		return nil
+	}
+	c := &http.Cookie{
+		Name:     u.sticky.Cookie,
+		Value:    u.sticky.sign(u.name, ipwc.origin.host),
+		Path:     u.sticky.Path,
+		Secure:   u.sticky.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if u.sticky.TTL > 0 {
+		c.MaxAge = int(u.sticky.TTL / time.Second)
+	}
+	return c
+}
@@ -0,0 +1,115 @@
+package upstream
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStickyCookie(t *testing.T) {
+	sc := &StickyConfig{Secret: "secret"}
+	assert.NoError(t, sc.setDefaults("api"))
+	v := sc.sign("api", "[2001:db8::1]:8080")
+	host, ok := sc.verify("api", v)
+	assert.True(t, ok)
+	assert.Equal(t, "[2001:db8::1]:8080", host)
+
+	_, ok = sc.verify("web", v)
+	assert.False(t, ok, "cookie of another pool")
+	_, ok = (&StickyConfig{Secret: "other"}).verify("api", v)
+	assert.False(t, ok, "cookie signed by another key")
+	_, ok = sc.verify("api", "MTkyLjAuMi4xOjgwODA."+v[len(v)-22:])
+	assert.False(t, ok, "forged host")
+	_, ok = sc.verify("api", "garbage")
+	assert.False(t, ok)
+
+	// pools have their own cookies by default
+	web := &StickyConfig{}
+	assert.NoError(t, web.setDefaults("web v2"))
+	assert.Equal(t, "chocon_affinity_api", sc.Cookie)
+	assert.Equal(t, "chocon_affinity_web_v2", web.Cookie)
+	custom := &StickyConfig{Cookie: "session_affinity"}
+	assert.NoError(t, custom.setDefaults("api"))
+	assert.Equal(t, "session_affinity", custom.Cookie)
+}
+
+func TestGetSticky(t *testing.T) {
+	u := newTestUpstream(3)
+	u.name = "api"
+	u.sticky = &StickyConfig{Secret: "secret", TTL: time.Hour}
+	assert.NoError(t, u.sticky.setDefaults(u.name))
+	ipwcs := u.IPwcs()
+
+	// first request is pinned by the cookie of response
+	h, ipwc, err := u.Get(&http.Request{Header: http.Header{}})
+	assert.NoError(t, err)
+	c := u.AffinityCookie(ipwc)
+	u.Release(ipwc)
+	if !assert.NotNil(t, c) {
+		return
+	}
+	assert.Equal(t, "chocon_affinity_api", c.Name)
+	assert.Equal(t, 3600, c.MaxAge)
+
+	req := &http.Request{Header: http.Header{}}
+	req.AddCookie(c)
+	held := []*IPwc{}
+	for i := 0; i < 5; i++ {
+		ph, ipwc, err := u.Get(req)
+		assert.NoError(t, err)
+		assert.Equal(t, h, ph)
+		assert.Nil(t, u.AffinityCookie(ipwc))
+		held = append(held, ipwc)
+	}
+	for _, ipwc := range held {
+		u.Release(ipwc)
+	}
+
+	// retry on another IP re-pins
+	_, pipwc, _ := u.Get(req)
+	rh, ripwc, err := u.Get(req, pipwc)
+	assert.NoError(t, err)
+	assert.NotEqual(t, h, rh)
+	assert.NotNil(t, u.AffinityCookie(ripwc))
+	u.Release(pipwc)
+	u.Release(ripwc)
+
+	// unhealthy IP re-pins
+	var pinned *IPwc
+	for _, ipwc := range ipwcs {
+		if ipwc.host == h {
+			pinned = ipwc
+		}
+	}
+	pinned.healthy.Store(false)
+	rh, ripwc, err = u.Get(req)
+	assert.NoError(t, err)
+	assert.NotEqual(t, h, rh)
+	assert.NotNil(t, u.AffinityCookie(ripwc))
+	u.Release(ripwc)
+	pinned.healthy.Store(true)
+
+	// IP removed from the pool re-pins
+	rest := make([]*IPwc, 0, 2)
+	for _, ipwc := range ipwcs {
+		if ipwc != pinned {
+			rest = append(rest, ipwc)
+		}
+	}
+	u.ipwcs.Store(&rest)
+	rh, ripwc, err = u.Get(req)
+	assert.NoError(t, err)
+	assert.NotEqual(t, h, rh)
+	assert.NotNil(t, u.AffinityCookie(ripwc))
+	u.Release(ripwc)
+}
+
+func TestStickyDisabled(t *testing.T) {
+	u := newTestUpstream(2)
+	_, ipwc, err := u.Get(&http.Request{Header: http.Header{}})
+	assert.NoError(t, err)
+	assert.Nil(t, u.AffinityCookie(ipwc))
+	u.Release(ipwc)
+}
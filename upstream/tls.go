@@ -0,0 +1,51 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// ServerName : TLS server name for addr (ip:port) chosen by Get.
+// override by config, hostname the IP resolved from, or upstream hostname
+func (u *Upstream) ServerName(addr string) string {
+	if u.tlsServerName != "" {
+		return u.tlsServerName
+	}
+	for _, ipwc := range u.IPwcs() {
+		if ipwc.host == addr || u.dialAddr(ipwc) == addr {
+			return ipwc.hostname
+		}
+	}
+	return u.host
+}
+
+// TLSDialer : DialTLSContext of http.Transport for https upstream. request
+// URL has the IP chosen by Get, so the handshake does SNI and certificate
+// verification with ServerName of the address. config is cloned for each
+// connection. nil uses default
+func (u *Upstream) TLSDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error), config *tls.Config, handshakeTimeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg := &tls.Config{}
+		if config != nil {
+			cfg = config.Clone()
+		}
+		cfg.ServerName = u.ServerName(addr)
+		if handshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, handshakeTimeout)
+			defer cancel()
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
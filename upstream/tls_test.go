@@ -0,0 +1,74 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestServerName(t *testing.T) {
+	// port-less https address is dialed on 443
+	u, err := New(Config{URL: "https://api.internal/", Members: []MemberConfig{{Host: "192.0.2.1"}}}, zap.NewNop())
+	assert.NoError(t, err)
+	h, ipwc, err := u.Get(nil)
+	assert.NoError(t, err)
+	u.Release(ipwc)
+	assert.Equal(t, "192.0.2.1", h)
+	assert.Equal(t, "api.internal", u.ServerName(h))
+	assert.Equal(t, "api.internal", u.ServerName("192.0.2.1:443"))
+
+	// override
+	u, err = New(Config{URL: "https://192.0.2.1/", TLSServerName: "api.example.com"}, zap.NewNop())
+	assert.NoError(t, err)
+	assert.Equal(t, "api.example.com", u.ServerName("192.0.2.1:443"))
+
+	// SRV target hostname
+	u = &Upstream{scheme: "https", host: "_api._tcp.service.internal", logger: zap.NewNop()}
+	ipwcs := []*IPwc{
+		u.newIPwc(target{ip: "192.0.2.1", port: "8443", hostname: "a.service.internal", weight: 1}),
+		u.newIPwc(target{ip: "192.0.2.2", port: "8443", hostname: "b.service.internal", weight: 1}),
+	}
+	u.ipwcs.Store(&ipwcs)
+	assert.Equal(t, "a.service.internal", u.ServerName("192.0.2.1:8443"))
+	assert.Equal(t, "b.service.internal", u.ServerName("192.0.2.2:8443"))
+}
+
+func TestTLSDialer(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	config := &tls.Config{RootCAs: roots}
+	d := &net.Dialer{}
+
+	// certificate of httptest server is for example.com
+	u, err := New(Config{URL: ts.URL, TLSServerName: "example.com"}, zap.NewNop())
+	assert.NoError(t, err)
+	h, ipwc, err := u.Get(nil)
+	assert.NoError(t, err)
+	defer u.Release(ipwc)
+	client := &http.Client{Transport: &http.Transport{DialTLSContext: u.TLSDialer(d.DialContext, config, time.Second)}}
+	res, err := client.Get("https://" + h + "/")
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	// verification fails for a wrong name
+	u, err = New(Config{URL: ts.URL, TLSServerName: "api.invalid"}, zap.NewNop())
+	assert.NoError(t, err)
+	_, err = u.TLSDialer(d.DialContext, config, time.Second)(context.Background(), "tcp", h)
+	var verr *tls.CertificateVerificationError
+	assert.True(t, errors.As(err, &verr), "got %v", err)
+	// config is not modified
+	assert.Empty(t, config.ServerName)
+}
@@ -2,85 +2,430 @@ package upstream
 
 import (
 	"context"
-	"math/rand"
+	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/kazeburo/chocon/breaker"
+	"github.com/kazeburo/chocon/resolver"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// Config : upstream pool configuration
+type Config struct {
+	// Name of the pool, referenced by routes
+	Name string `yaml:"name"`
+	// URL of the upstream server: http://upstream-server/
+	// or srv+http://_service._tcp.upstream-server/ to discover by SRV records.
+	// path and query of URL are prepended to request path and query
+	URL string `yaml:"url"`
+	// prefix removed from request path before sending upstream
+	StripPrefix string `yaml:"strip_prefix"`
+	// active health check. disabled if nil
+	HealthCheck *HealthCheckConfig `yaml:"health_check"`
+	// passive outlier ejection. disabled if nil
+	Outlier *OutlierConfig `yaml:"outlier"`
+	// load balancing algorithm
+	Balancer BalancerConfig `yaml:"balancer"`
+	// weight by ip:port, or by IP for all ports. default 1 or weight of SRV record
+	Weights map[string]int64 `yaml:"weights"`
+	// DNS resolver. system resolver by default
+	Resolver resolver.Config `yaml:"resolver"`
+	// policy of serving stale addresses
+	Stale StaleConfig `yaml:"stale"`
+	// TLS server name (SNI and certificate verification) of https upstream.
+	// default upstream hostname, or target hostname of SRV record
+	TLSServerName string `yaml:"tls_server_name"`
+	// retry on another IP. disabled if nil
+	Retry *RetryConfig `yaml:"retry"`
+	// circuit breaker by IP. disabled if nil
+	CircuitBreaker *breaker.Config `yaml:"circuit_breaker"`
+	// explicit members instead of resolving hostname of URL
+	Members []MemberConfig `yaml:"members"`
+	// JSON or YAML file of members, reloaded on change
+	MembersFile string `yaml:"members_file"`
+	// discover members by Consul-compatible catalog
+	Consul *ConsulConfig `yaml:"consul"`
+	// ramp up weight of newly resolved IPs
+	SlowStart SlowStartConfig `yaml:"slow_start"`
+	// ipv4, ipv6, prefer_ipv4 or prefer_ipv6. both families are used equally by default
+	AddressFamily string `yaml:"address_family"`
+	// delay before falling back to the other address family. default 300ms, -1 disables
+	HappyEyeballsDelay time.Duration `yaml:"happy_eyeballs_delay"`
+	// cookie affinity of clients to IPs. disabled if nil
+	Sticky *StickyConfig `yaml:"sticky"`
+	// name of the pool that serves requests while this pool has no usable IPs.
+	// the backup pool may have its own backup
+	Backup string `yaml:"backup"`
+	// limit of concurrent requests by IP. unlimited if nil
+	Concurrency *ConcurrencyConfig `yaml:"concurrency"`
+	// prefer IPs in local zone. disabled if nil
+	Zone *ZoneConfig `yaml:"zone"`
+}
+
 // Upstream struct
 type Upstream struct {
+	name   string
 	scheme string
 	port   string
 	host   string
-	ipwcs  []*IPwc
+	// path and query of URL
+	basePath    string
+	baseRawPath string
+	rawQuery    string
+	stripPrefix string
+	// source of targets: lookupIP, lookupSRV, members or consul
+	lookup      func(context.Context) ([]target, time.Duration, error)
+	membersFile string
+	consul      *consulDiscovery
+	// requests immediate refresh
+	reload chan struct{}
+	// connections by dial address
+	connsMu sync.Mutex
+	conns   map[string]map[*trackedConn]struct{}
+	// current IPs. replaced as a whole on refresh, read without lock
+	ipwcs  atomic.Pointer[[]*IPwc]
 	csum   string
 	logger *zap.Logger
-	mu     sync.Mutex
+	// serializes refresh and ejection
+	mu sync.Mutex
 	// current resolved record version
 	version uint64
+
+	resolver *resolver.Resolver
+	// TTL of last resolved records. 0 if unknown
+	ttl time.Duration
+	// address family preference and Happy Eyeballs delay
+	family        string
+	fallbackDelay time.Duration
+
+	stale         StaleConfig
+	tlsServerName string
+	// last successful refresh
+	lastRefresh time.Time
+	lastError   string
+	// when the pool became stale. zero if fresh
+	staleSince  time.Time
+	staleReason string
+
+	healthCheck *HealthCheckConfig
+	outlier     *OutlierConfig
+	retry       *RetryConfig
+	// circuit breaker config of each IP
+	circuitBreaker *breaker.Config
+	// nil if slow start is disabled
+	slowStart *SlowStartConfig
+	// nil if cookie affinity is disabled
+	sticky *StickyConfig
+	// nil if concurrent requests are not limited
+	concurrency *ConcurrencyConfig
+	balancer    Balancer
+	weights     map[string]int64
+	// pool serving requests while no IP is usable. nil if none
+	backup *Upstream
+	// pool chosen by last Select. nil until then
+	active atomic.Pointer[Upstream]
+	// nil if zone aware routing is disabled
+	zone *zoneRouting
+	// requests spill over to other zones
+	spillover atomic.Bool
+	// unix nano of the last spillover log, and transitions since then
+	spillLogged atomic.Int64
+	spillFlips  atomic.Int64
 }
 
-// IPwc : IP with counter
+// IPwc : IP with counter. an IPwc lives as long as its IP is resolved.
+// Get returns a per-request copy that refers the shared one by origin
 type IPwc struct {
-	ip string
+	ip   string
+	port string
+	// hostname the IP resolved from
+	hostname string
+	// host to set in proxy request
+	host string
+	// lower is preferred. from SRV record
+	priority uint16
+	// 1 if the IP is not in preferred address family
+	familyRank uint8
+	// availability zone. empty if unknown
+	zone string
 	// # requerst in busy
-	busy int64
-	// resolved record version
+	busy atomic.Int64
+	// # requests sent
+	requests atomic.Uint64
+	// removed from the pool. connections are closed when busy gets 0
+	removed atomic.Bool
+	// record version the IP first resolved
 	version uint64
+	// weight for weighted balancers
+	weight int64
+	// when the IP was added to the pool. zero if the IP is in the initial
+	// pool or slow start is disabled
+	added     time.Time
+	slowStart *SlowStartConfig
+	// active health check state
+	healthy atomic.Bool
+	health  healthState
+	// unix nano until the IP is ejected
+	ejectedUntil atomic.Int64
+	// nil if circuit breaker is disabled
+	breaker *breaker.Breaker
+	// nil if concurrent requests are not limited
+	limiter *limiter
+
+	// protects outlier and peak_ewma state
+	mu      sync.Mutex
+	outlier outlierState
+	// state of peak_ewma
+	ewma      float64
+	ewmaStamp time.Time
+
+	// per-request copy only
+	origin *IPwc
+	start  time.Time
+	// admission of circuit breaker and outcome reported
+	done    func(breaker.Outcome)
+	outcome breaker.Outcome
+	// chosen by affinity cookie of request
+	pinned bool
+}
+
+// target : a resolved address
+type target struct {
+	ip       string
+	port     string
+	hostname string
+	priority uint16
+	weight   int64
+	// zone from discovery metadata
+	zone string
+}
+
+func (t target) host() string {
+	return hostPort(t.ip, t.port)
+}
+
+// targetWeight : weight of target overridden by config weights
+func (u *Upstream) targetWeight(t target) int64 {
+	weight := t.weight
+	if w, ok := u.weights[t.host()]; ok && w > 0 {
+		weight = w
+	} else if w, ok := u.weights[t.ip]; ok && w > 0 {
+		weight = w
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	return weight
+}
+
+func (u *Upstream) newIPwc(t target) *IPwc {
+	ipwc := &IPwc{
+		ip:       t.ip,
+		port:     t.port,
+		hostname: t.hostname,
+		host:     t.host(),
+		priority: t.priority,
+		version:  u.version,
+		weight:   u.targetWeight(t),
+		breaker:  u.newBreaker(t.host()),
+		limiter:  newLimiter(u.concurrency),
+		zone:     u.zoneOf(t),
+
+		familyRank: u.familyRank(t.ip),
+		slowStart:  u.slowStart,
+	}
+	ipwc.healthy.Store(true)
+	return ipwc
 }
 
 // New :
-func New(upstream string, logger *zap.Logger) (*Upstream, error) {
+func New(cfg Config, logger *zap.Logger) (*Upstream, error) {
 	var h string
 	var p string
+	var srv bool
 	var err error
 	u := new(url.URL)
 
-	if upstream != "" {
-		u, err = url.Parse(upstream)
+	if cfg.URL != "" {
+		u, err = url.Parse(cfg.URL)
 		if err != nil {
 			return nil, errors.Wrap(err, "upsteam url is invalid")
 		}
+		if u.Scheme == "srv+http" || u.Scheme == "srv+https" {
+			srv = true
+			u.Scheme = strings.TrimPrefix(u.Scheme, "srv+")
+		}
 		if u.Scheme != "http" && u.Scheme != "https" {
-			return nil, errors.New("upsteam url is invalid: upsteam url scheme should be http or https")
+			return nil, errors.New("upsteam url is invalid: upsteam url scheme should be http, https, srv+http or srv+https")
 		}
 		if u.Host == "" {
 			return nil, errors.New("upsteam url is invalid: no hostname")
 		}
 
-		hostPortSplit := strings.Split(u.Host, ":")
-		h = hostPortSplit[0]
-		p = ""
-		if len(hostPortSplit) > 1 {
-			p = hostPortSplit[1]
+		// brackets of IPv6 literal are removed
+		h = u.Hostname()
+		p = u.Port()
+		if srv && p != "" {
+			return nil, errors.New("upsteam url is invalid: port is given by SRV records")
+		}
+	}
+	if err := checkFamily(cfg.AddressFamily); err != nil {
+		return nil, err
+	}
+	if cfg.StripPrefix != "" && !strings.HasPrefix(cfg.StripPrefix, "/") {
+		return nil, errors.Errorf("strip_prefix should start with /: %s", cfg.StripPrefix)
+	}
+	sources := 0
+	for _, set := range []bool{srv, len(cfg.Members) > 0, cfg.MembersFile != "", cfg.Consul != nil} {
+		if set {
+			sources++
 		}
 	}
+	if sources > 1 {
+		return nil, errors.New("srv+ scheme, members, members_file and consul are exclusive")
+	}
+
+	balancer, err := newBalancer(cfg.Balancer)
+	if err != nil {
+		return nil, err
+	}
+	rslv, err := resolver.New(cfg.Resolver)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Stale.validate(); err != nil {
+		return nil, err
+	}
 
 	um := &Upstream{
-		scheme:  u.Scheme,
-		host:    h,
-		port:    p,
-		version: 0,
-		logger:  logger,
+		name:     cfg.Name,
+		balancer: balancer,
+		resolver: rslv,
+		stale:    cfg.Stale,
+
+		tlsServerName: cfg.TLSServerName,
+		weights:       cfg.Weights,
+		scheme:        u.Scheme,
+		host:          h,
+		port:          p,
+		basePath:      u.Path,
+		baseRawPath:   u.RawPath,
+		rawQuery:      u.RawQuery,
+		stripPrefix:   cfg.StripPrefix,
+		family:        cfg.AddressFamily,
+		fallbackDelay: cfg.HappyEyeballsDelay,
+		membersFile:   cfg.MembersFile,
+		reload:        make(chan struct{}, 1),
+		version:       0,
+		logger:        logger.With(zap.String("upstream", cfg.Name)),
+	}
+
+	if cfg.HealthCheck != nil {
+		hc := *cfg.HealthCheck
+		if err := hc.setDefaults(); err != nil {
+			return nil, err
+		}
+		um.healthCheck = &hc
+	}
+	if cfg.Outlier != nil {
+		oc := *cfg.Outlier
+		oc.setDefaults()
+		um.outlier = &oc
+	}
+	if cfg.Retry != nil && cfg.Retry.Attempts > 0 {
+		rc := *cfg.Retry
+		if err := rc.setDefaults(); err != nil {
+			return nil, err
+		}
+		um.retry = &rc
+	}
+	if um.fallbackDelay == 0 {
+		um.fallbackDelay = defaultFallbackDelay
+	}
+	if cfg.SlowStart.Window > 0 {
+		sc := cfg.SlowStart
+		sc.setDefaults()
+		um.slowStart = &sc
+	}
+	if cfg.Sticky != nil {
+		sc := *cfg.Sticky
+		if err := sc.setDefaults(cfg.Name); err != nil {
+			return nil, err
+		}
+		um.sticky = &sc
+	}
+	if cfg.Concurrency != nil {
+		cc := *cfg.Concurrency
+		if err := cc.setDefaults(); err != nil {
+			return nil, err
+		}
+		um.concurrency = &cc
 	}
+	if cfg.Zone != nil {
+		zr, err := newZoneRouting(*cfg.Zone)
+		if err != nil {
+			return nil, err
+		}
+		um.zone = zr
+	}
+	if cfg.CircuitBreaker != nil {
+		bc := *cfg.CircuitBreaker
+		bc.SetDefaults()
+		um.circuitBreaker = &bc
+	}
+	switch {
+	case srv:
+		um.lookup = um.lookupSRV
+	case len(cfg.Members) > 0:
+		members := cfg.Members
+		um.lookup = func(ctx context.Context) ([]target, time.Duration, error) {
+			return um.lookupMembers(ctx, members)
+		}
+	case cfg.MembersFile != "":
+		um.lookup = um.lookupMembersFile
+	case cfg.Consul != nil:
+		cc := *cfg.Consul
+		if err := cc.setDefaults(); err != nil {
+			return nil, err
+		}
+		um.consul = newConsulDiscovery(cc)
+		um.lookup = um.lookupConsul
+	default:
+		um.lookup = um.lookupIP
+	}
+	um.ipwcs.Store(&[]*IPwc{})
 
 	if um.Enabled() {
 		ctx := context.Background()
 		ipwcs, err := um.RefreshIP(ctx)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed initial resolv hostname")
+		if err == nil && len(ipwcs) < 1 {
+			err = errors.New("Could not resolv hostname")
 		}
-		if len(ipwcs) < 1 {
-			return nil, errors.New("Could not resolv hostname")
+		if err != nil {
+			if cfg.Backup == "" {
+				return nil, errors.Wrap(err, "failed initial resolv hostname")
+			}
+			// backup serves requests until hostname is resolved
+			um.logger.Warn("failed initial resolv hostname", zap.Error(err))
 		}
 		go um.Run(ctx)
+		if um.membersFile != "" {
+			um.watchMembersFile(ctx)
+		}
+		if um.consul != nil && um.consul.cfg.Wait > 0 {
+			go um.watchConsul(ctx)
+		}
+		if um.healthCheck != nil {
+			go um.runHealthCheck(ctx)
+		}
 	}
 	return um, nil
 }
@@ -90,6 +435,11 @@ func (u *Upstream) Enabled() bool {
 	return u.scheme != ""
 }
 
+// Name : get upstream's pool name
+func (u *Upstream) Name() string {
+	return u.name
+}
+
 // GetScheme : get upstream's scheme
 func (u *Upstream) GetScheme() string {
 	return u.scheme
@@ -101,93 +451,291 @@ func (u *Upstream) RefreshIP(ctx context.Context) ([]*IPwc, error) {
 	u.version++
 	u.mu.Unlock()
 
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.host)
+	ctx, cancel := context.WithTimeout(ctx, u.resolver.Timeout())
+	targets, ttl, err := u.lookup(ctx)
 	cancel()
+	if err == nil {
+		targets = u.filterFamily(targets)
+	}
+	u.mu.Lock()
+	u.ttl = ttl
+	err = u.checkAnswer(targets, err, time.Now())
+	u.mu.Unlock()
 	if err != nil {
 		return nil, err
 	}
 
-	sort.Slice(addrs, func(i, j int) bool {
-		return addrs[i].IP.String() > addrs[j].IP.String()
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].host() > targets[j].host()
 	})
 
-	ips := make([]string, len(addrs))
-	ipwcs := make([]*IPwc, len(addrs))
-	for i, ia := range addrs {
-		ips[i] = ia.IP.String()
-		ipwcs[i] = &IPwc{
-			ip:      ia.IP.String(),
-			version: u.version,
-			busy:    0,
-		}
+	keys := make([]string, len(targets))
+	for i, t := range targets {
+		keys[i] = fmt.Sprintf("%s/%d/%d/%s", t.host(), t.priority, t.weight, t.zone)
 	}
-	csum := strings.Join(ips, ",")
+	csum := strings.Join(keys, ",")
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	if csum != u.csum {
-		u.csum = csum
-		u.ipwcs = ipwcs
+	if csum == u.csum {
+		return u.IPwcs(), nil
+	}
+
+	// keep state of IPs still resolved
+	current := make(map[string]*IPwc)
+	for _, ipwc := range u.IPwcs() {
+		current[ipwc.host] = ipwc
+	}
+	ipwcs := make([]*IPwc, len(targets))
+	for i, t := range targets {
+		old, ok := current[t.host()]
+		if ok && old.priority == t.priority && old.zone == u.zoneOf(t) &&
+			old.weight == u.targetWeight(t) && old.hostname == t.hostname {
+			ipwcs[i] = old
+			continue
+		}
+		ipwcs[i] = u.newIPwc(t)
+		if ok {
+			// record of the IP changed. it is not a new IP to slow start
+			ipwcs[i].added = old.added
+		} else if u.slowStart != nil && len(current) > 0 {
+			ipwcs[i].added = time.Now()
+		}
+	}
+	u.csum = csum
+	u.ipwcs.Store(&ipwcs)
+	for _, ipwc := range ipwcs {
+		delete(current, ipwc.host)
+	}
+	for _, ipwc := range current {
+		u.drain(ipwc)
 	}
 
 	return ipwcs, nil
 }
 
-// Run : resolv hostname in background
+func (u *Upstream) lookupIP(ctx context.Context) ([]target, time.Duration, error) {
+	ips, ttl, err := u.resolver.LookupIP(ctx, u.host)
+	if err != nil {
+		return nil, 0, err
+	}
+	targets := make([]target, len(ips))
+	for i, ip := range ips {
+		targets[i] = target{
+			ip:       ip.String(),
+			port:     u.port,
+			hostname: u.host,
+			weight:   1,
+		}
+	}
+	return targets, ttl, nil
+}
+
+// IPwcs : current IPs
+func (u *Upstream) IPwcs() []*IPwc {
+	return *u.ipwcs.Load()
+}
+
+// Run : resolv hostname in background. interval follows TTL of records.
+// members file is reloaded on change
 func (u *Upstream) Run(ctx context.Context) {
-	ticker := time.NewTicker(3 * time.Second)
-	defer ticker.Stop()
+	timer := time.NewTimer(u.refreshInterval())
+	defer timer.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case _ = <-ticker.C:
-			//for _, ipwc := range u.ipwcs {
-			//	log.Printf("%v", ipwc)
-			//}
-			_, err := u.RefreshIP(ctx)
-			if err != nil {
-				u.logger.Error("failed refresh ip", zap.Error(err))
+		case _ = <-timer.C:
+		case <-u.reload:
+			if !timer.Stop() {
+				<-timer.C
 			}
 		}
+		_, err := u.RefreshIP(ctx)
+		if err != nil {
+			u.logger.Error("failed refresh ip", zap.Error(err))
+		}
+		timer.Reset(u.refreshInterval())
 	}
 }
 
-// Get : wild
-func (u *Upstream) Get() (string, *IPwc, error) {
+func (u *Upstream) refreshInterval() time.Duration {
 	u.mu.Lock()
 	defer u.mu.Unlock()
+	return u.resolver.RefreshInterval(u.ttl)
+}
 
-	if len(u.ipwcs) < 1 {
+// Get : choose an IP by balancer, preferring local zone, or the IP named by
+// affinity cookie if it is usable. IPs in exclude are not chosen. waits in queue of the IP if
+// concurrent requests of all IPs are at limit.
+// returns ErrCircuitOpen if circuits of all other IPs are open, and
+// ErrQueueFull or ErrQueueTimeout if the request could not get a slot
+func (u *Upstream) Get(r *http.Request, exclude ...*IPwc) (string, *IPwc, error) {
+	ipwcs := u.IPwcs()
+	if len(ipwcs) < 1 {
 		return "", &IPwc{}, errors.New("No upstream hosts")
 	}
 
-	sort.Slice(u.ipwcs, func(i, j int) bool {
-		if u.ipwcs[i].busy == u.ipwcs[j].busy {
-			return rand.Intn(2) == 0
+	now := time.Now()
+	pinned := u.pinned(r, ipwcs)
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	for {
+		// open circuits are not failed open
+		allowed := filterIPwcs(ipwcs, func(ipwc *IPwc) bool {
+			return !excluded(ipwc, exclude) && ipwc.breakerReady(now)
+		})
+		if len(allowed) == 0 {
+			for _, ipwc := range ipwcs {
+				if !excluded(ipwc, exclude) {
+					return "", &IPwc{}, ErrCircuitOpen
+				}
+			}
+			return "", &IPwc{}, errors.New("No more upstream hosts")
+		}
+		// healthy and not ejected IPs. if every IP is unusable, fail open
+		candidates := filterIPwcs(allowed, func(ipwc *IPwc) bool {
+			return ipwc.usable(now)
+		})
+		if len(candidates) == 0 {
+			candidates = allowed
+		}
+		var chosen *IPwc
+		if pinned != nil && !excluded(pinned, exclude) && pinned.breakerReady(now) && pinned.usable(now) {
+			chosen = pinned
+		} else {
+			candidates = u.localZone(ipwcs, lowestPriority(candidates), now)
+			// IPs under concurrency limit. if all are at limit, wait in the
+			// shortest queue
+			if free := filterIPwcs(candidates, (*IPwc).free); len(free) > 0 {
+				candidates = free
+			} else {
+				candidates = shortestQueue(candidates)
+			}
+			chosen = u.balancer.Pick(candidates, r)
+		}
+		if chosen.limiter != nil {
+			if err := chosen.limiter.acquire(ctx); err != nil {
+				return "", &IPwc{}, err
+			}
 		}
-		return u.ipwcs[i].busy < u.ipwcs[j].busy
-	})
 
-	u.ipwcs[0].busy++
-	h := u.ipwcs[0].ip
-	if u.port != "" {
-		h = h + ":" + u.port
+		var done func(breaker.Outcome)
+		if chosen.breaker != nil {
+			var ok bool
+			if done, ok = chosen.breaker.Allow(); !ok {
+				// half-open slots were taken by other requests
+				if chosen.limiter != nil {
+					chosen.limiter.release()
+				}
+				exclude = append(exclude[:len(exclude):len(exclude)], &IPwc{origin: chosen})
+				continue
+			}
+		}
+		chosen.busy.Add(1)
+		chosen.requests.Add(1)
+		ipwc := &IPwc{
+			ip:      chosen.ip,
+			version: chosen.version,
+			origin:  chosen,
+			start:   now,
+			done:    done,
+			pinned:  chosen == pinned,
+		}
+		return chosen.host, ipwc, nil
 	}
-	ipwc := &IPwc{
-		ip:      u.ipwcs[0].ip,
-		version: u.ipwcs[0].version,
+}
+
+// filterIPwcs : IPs matching f. returns ipwcs itself if all IPs match
+func filterIPwcs(ipwcs []*IPwc, f func(*IPwc) bool) []*IPwc {
+	for i, ipwc := range ipwcs {
+		if f(ipwc) {
+			continue
+		}
+		filtered := make([]*IPwc, 0, len(ipwcs))
+		filtered = append(filtered, ipwcs[:i]...)
+		for _, ipwc := range ipwcs[i+1:] {
+			if f(ipwc) {
+				filtered = append(filtered, ipwc)
+			}
+		}
+		return filtered
+	}
+	return ipwcs
+}
+
+func excluded(ipwc *IPwc, exclude []*IPwc) bool {
+	for _, e := range exclude {
+		if e.origin == ipwc {
+			return true
+		}
 	}
-	return h, ipwc, nil
+	return false
 }
 
-// Release : decrement counter
+// Release : decrement counter and close circuit breaker admission
 func (u *Upstream) Release(o *IPwc) {
-	u.mu.Lock()
-	defer u.mu.Unlock()
-	for i, ipwc := range u.ipwcs {
-		if ipwc.ip == o.ip && ipwc.version == o.version {
-			u.ipwcs[i].busy = u.ipwcs[i].busy - 1
+	if o.origin == nil {
+		return
+	}
+	if o.origin.limiter != nil {
+		o.origin.limiter.release()
+	}
+	if o.origin.busy.Add(-1) == 0 && o.origin.removed.Load() {
+		u.closeConns(o.origin)
+	}
+	o.breakerDone()
+	if lo, ok := u.balancer.(latencyObserver); ok {
+		lo.Observe(o.origin, time.Since(o.start))
+	}
+}
+
+// free : a request can be sent without waiting in queue
+func (ipwc *IPwc) free() bool {
+	return ipwc.limiter == nil || ipwc.limiter.free()
+}
+
+func (ipwc *IPwc) usable(now time.Time) bool {
+	return ipwc.healthy.Load() && now.UnixNano() >= ipwc.ejectedUntil.Load()
+}
+
+// rank : priority, then address family preference. lower is preferred
+func (ipwc *IPwc) rank() uint32 {
+	return uint32(ipwc.priority)<<8 | uint32(ipwc.familyRank)
+}
+
+// lowestPriority : candidates with the lowest rank
+func lowestPriority(candidates []*IPwc) []*IPwc {
+	min := candidates[0].rank()
+	same := true
+	for _, c := range candidates[1:] {
+		if r := c.rank(); r != min {
+			same = false
+			if r < min {
+				min = r
+			}
+		}
+	}
+	if same {
+		return candidates
+	}
+	filtered := make([]*IPwc, 0, len(candidates))
+	for _, c := range candidates {
+		if c.rank() == min {
+			filtered = append(filtered, c)
 		}
 	}
+	return filtered
+}
+
+// dialAddr : address to dial. default port of scheme is used if target has no port
+func (u *Upstream) dialAddr(ipwc *IPwc) string {
+	if ipwc.port != "" {
+		return net.JoinHostPort(ipwc.ip, ipwc.port)
+	}
+	if u.scheme == "https" {
+		return net.JoinHostPort(ipwc.ip, "443")
+	}
+	return net.JoinHostPort(ipwc.ip, "80")
 }
@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func testIPwc(ip string, weight int64) *IPwc {
+	u := &Upstream{}
+	return u.newIPwc(target{ip: ip, port: "8080", weight: weight})
+}
+
+func newTestUpstream(n int) *Upstream {
+	u := &Upstream{
+		port:     "8080",
+		balancer: &leastBusy{},
+		logger:   zap.NewNop(),
+	}
+	ipwcs := make([]*IPwc, n)
+	for i := range ipwcs {
+		ipwcs[i] = testIPwc(fmt.Sprintf("192.0.2.%d", i+1), 1)
+	}
+	u.ipwcs.Store(&ipwcs)
+	return u
+}
+
+func TestGetLeastBusy(t *testing.T) {
+	u := newTestUpstream(3)
+	held := []*IPwc{}
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		h, ipwc, err := u.Get(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, ipwc.ip+":8080", h)
+		seen[ipwc.ip]++
+		held = append(held, ipwc)
+	}
+	assert.Equal(t, map[string]int{"192.0.2.1": 2, "192.0.2.2": 2, "192.0.2.3": 2}, seen)
+	for _, ipwc := range held {
+		u.Release(ipwc)
+	}
+	for _, ipwc := range u.IPwcs() {
+		assert.Equal(t, int64(0), ipwc.busy.Load())
+	}
+}
+
+func TestGetNoHosts(t *testing.T) {
+	u := newTestUpstream(0)
+	_, ipwc, err := u.Get(nil)
+	assert.Error(t, err)
+	u.Release(ipwc)
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, n := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("ips=%d", n), func(b *testing.B) {
+			u := newTestUpstream(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, ipwc, _ := u.Get(nil)
+					u.Release(ipwc)
+				}
+			})
+		})
+	}
+}
+
+func TestGetPriority(t *testing.T) {
+	u := newTestUpstream(0)
+	ipwcs := []*IPwc{
+		u.newIPwc(target{ip: "192.0.2.1", port: "8001", priority: 10, weight: 1}),
+		u.newIPwc(target{ip: "192.0.2.2", port: "8002", priority: 10, weight: 3}),
+		u.newIPwc(target{ip: "192.0.2.3", port: "8003", priority: 20, weight: 1}),
+	}
+	u.ipwcs.Store(&ipwcs)
+
+	seen := map[string]int{}
+	for i := 0; i < 8; i++ {
+		h, _, err := u.Get(nil)
+		assert.NoError(t, err)
+		seen[h]++
+	}
+	// weighted least busy within the lowest priority
+	assert.Equal(t, map[string]int{"192.0.2.1:8001": 2, "192.0.2.2:8002": 6}, seen)
+
+	ipwcs[0].healthy.Store(false)
+	ipwcs[1].healthy.Store(false)
+	h, _, err := u.Get(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.3:8003", h)
+}
@@ -0,0 +1,40 @@
+package upstream
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// filePollInterval : interval of checking a file without inotify
+const filePollInterval = 2 * time.Second
+
+// pollFile : call notify when modification time or size of path changes
+func pollFile(ctx context.Context, path string, interval time.Duration, notify func()) {
+	var mtime time.Time
+	var size int64 = -1
+	if fi, err := os.Stat(path); err == nil {
+		mtime, size = fi.ModTime(), fi.Size()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(path)
+			if err != nil {
+				if size != -1 {
+					size = -1
+					notify()
+				}
+				continue
+			}
+			if !fi.ModTime().Equal(mtime) || fi.Size() != size {
+				mtime, size = fi.ModTime(), fi.Size()
+				notify()
+			}
+		}
+	}
+}
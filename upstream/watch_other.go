@@ -0,0 +1,13 @@
+//go:build !linux
+
+package upstream
+
+import (
+	"context"
+)
+
+// watchFile : poll path. inotify is available on linux only
+func watchFile(ctx context.Context, path string, notify func()) error {
+	go pollFile(ctx, path, filePollInterval, notify)
+	return nil
+}
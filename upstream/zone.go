@@ -0,0 +1,166 @@
+package upstream
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ZoneConfig : prefer IPs in the same zone as chocon
+type ZoneConfig struct {
+	// zone of this chocon. default --zone
+	Local string `yaml:"local"`
+	// zone by CIDR for IPs without zone from members or consul.
+	// the longest prefix wins
+	CIDRs map[string]string `yaml:"cidrs"`
+	// spill over to other zones if usable IPs in local zone are fewer than
+	// this percentage of IPs in local zone. 0 spills over only when no IP
+	// in local zone is usable
+	MinHealthyPercent int `yaml:"min_healthy_percent"`
+	// spill over to other zones if in-flight requests per usable IP in
+	// local zone reach this. 0 disables
+	MaxBusy int64 `yaml:"max_busy"`
+}
+
+// spillExitPercent : spillover by max_busy ends when in-flight requests fall
+// below this percentage of max_busy, so that it does not flip on every
+// request around max_busy
+const spillExitPercent = 80
+
+// spillLogInterval : spillover transitions are logged at most once in this interval
+const spillLogInterval = 10 * time.Second
+
+type zoneCIDR struct {
+	ipnet *net.IPNet
+	zone  string
+}
+
+// zoneRouting : parsed ZoneConfig
+type zoneRouting struct {
+	cfg   ZoneConfig
+	cidrs []zoneCIDR
+}
+
+func newZoneRouting(cfg ZoneConfig) (*zoneRouting, error) {
+	if cfg.Local == "" {
+		return nil, errors.New("local zone is required")
+	}
+	if cfg.MinHealthyPercent < 0 || cfg.MinHealthyPercent > 100 {
+		return nil, errors.Errorf("min_healthy_percent should be 0-100: %d", cfg.MinHealthyPercent)
+	}
+	zr := &zoneRouting{cfg: cfg}
+	for cidr, zone := range cfg.CIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid zone cidr")
+		}
+		zr.cidrs = append(zr.cidrs, zoneCIDR{ipnet: ipnet, zone: zone})
+	}
+	return zr, nil
+}
+
+// zoneOf : zone of IP by CIDR. empty if unknown
+func (zr *zoneRouting) zoneOf(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	zone := ""
+	longest := -1
+	for _, c := range zr.cidrs {
+		if ones, _ := c.ipnet.Mask.Size(); c.ipnet.Contains(parsed) && ones > longest {
+			zone = c.zone
+			longest = ones
+		}
+	}
+	return zone
+}
+
+// zoneOf : zone of target from discovery, or by CIDR
+func (u *Upstream) zoneOf(t target) string {
+	if t.zone != "" || u.zone == nil {
+		return t.zone
+	}
+	return u.zone.zoneOf(t.ip)
+}
+
+// localZone : candidates in local zone, or all candidates if capacity of
+// local zone is short. ipwcs are all IPs of the pool
+func (u *Upstream) localZone(ipwcs, candidates []*IPwc, now time.Time) []*IPwc {
+	if u.zone == nil {
+		return candidates
+	}
+	local := u.zone.cfg.Local
+	inLocal := func(ipwc *IPwc) bool {
+		return ipwc.zone == local
+	}
+	all := filterIPwcs(ipwcs, inLocal)
+	if len(all) == 0 {
+		return candidates
+	}
+	spill := u.shortOfCapacity(all, now, u.spillover.Load())
+	if u.spillover.Swap(spill) != spill {
+		u.logSpill(spill, now)
+	}
+	if spill {
+		return candidates
+	}
+	inZone := filterIPwcs(candidates, inLocal)
+	if len(inZone) == 0 {
+		// IPs in local zone were excluded by retry
+		return candidates
+	}
+	return inZone
+}
+
+// logSpill : log transition of spillover with the number of transitions
+// since the last log
+func (u *Upstream) logSpill(spill bool, now time.Time) {
+	u.spillFlips.Add(1)
+	last := u.spillLogged.Load()
+	if now.UnixNano()-last < int64(spillLogInterval) || !u.spillLogged.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	fields := []zap.Field{
+		zap.String("zone", u.zone.cfg.Local),
+		zap.Int64("transitions", u.spillFlips.Swap(0)),
+	}
+	if spill {
+		u.logger.Warn("spill over to other zones", fields...)
+	} else {
+		u.logger.Info("back to local zone", fields...)
+	}
+}
+
+// shortOfCapacity : usable IPs in local zone are too few or saturated.
+// spilling is the current state
+func (u *Upstream) shortOfCapacity(local []*IPwc, now time.Time, spilling bool) bool {
+	var usable, busy int64
+	free := false
+	for _, ipwc := range local {
+		if !ipwc.usable(now) || !ipwc.breakerReady(now) {
+			continue
+		}
+		usable++
+		busy += ipwc.busy.Load()
+		if ipwc.free() {
+			free = true
+		}
+	}
+	if usable == 0 || usable*100 < int64(len(local)*u.zone.cfg.MinHealthyPercent) {
+		return true
+	}
+	if u.zone.cfg.MaxBusy > 0 {
+		limit := u.zone.cfg.MaxBusy * usable * 100
+		if spilling {
+			limit = limit * spillExitPercent / 100
+		}
+		if busy*100 >= limit {
+			return true
+		}
+	}
+	// all IPs in local zone are at concurrency limit
+	return !free
+}
@@ -0,0 +1,168 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"gopkg.in/yaml.v3"
+)
+
+func TestZoneOf(t *testing.T) {
+	zr, err := newZoneRouting(ZoneConfig{
+		Local: "a",
+		CIDRs: map[string]string{
+			"10.0.0.0/8":     "a",
+			"10.1.0.0/16":    "b",
+			"2001:db8::/32":  "c",
+			"192.0.2.128/25": "d",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "a", zr.zoneOf("10.2.3.4"))
+	assert.Equal(t, "b", zr.zoneOf("10.1.3.4"))
+	assert.Equal(t, "c", zr.zoneOf("2001:db8::1"))
+	assert.Equal(t, "", zr.zoneOf("192.0.2.1"))
+
+	u := &Upstream{zone: zr}
+	assert.Equal(t, "b", u.zoneOf(target{ip: "10.2.3.4", zone: "b"}), "zone from discovery")
+	assert.Equal(t, "a", u.zoneOf(target{ip: "10.2.3.4"}))
+
+	_, err = newZoneRouting(ZoneConfig{})
+	assert.Error(t, err)
+	_, err = newZoneRouting(ZoneConfig{Local: "a", CIDRs: map[string]string{"10.0.0.0": "a"}})
+	assert.Error(t, err)
+}
+
+func newZoneUpstream(t *testing.T, cfg ZoneConfig) (*Upstream, []*IPwc) {
+	u := newTestUpstream(4)
+	zr, err := newZoneRouting(cfg)
+	assert.NoError(t, err)
+	u.zone = zr
+	ipwcs := u.IPwcs()
+	for i, ipwc := range ipwcs {
+		ipwc.zone = "a"
+		if i >= 2 {
+			ipwc.zone = "b"
+		}
+	}
+	return u, ipwcs
+}
+
+func getZones(t *testing.T, u *Upstream, n int) map[string]int {
+	seen := map[string]int{}
+	held := []*IPwc{}
+	for i := 0; i < n; i++ {
+		_, ipwc, err := u.Get(nil)
+		assert.NoError(t, err)
+		seen[ipwc.origin.zone]++
+		held = append(held, ipwc)
+	}
+	for _, ipwc := range held {
+		u.Release(ipwc)
+	}
+	return seen
+}
+
+func TestGetLocalZone(t *testing.T) {
+	u, ipwcs := newZoneUpstream(t, ZoneConfig{Local: "a"})
+	assert.Equal(t, map[string]int{"a": 8}, getZones(t, u, 8))
+	assert.False(t, u.Status().Spillover)
+
+	// one local IP is enough
+	ipwcs[0].healthy.Store(false)
+	assert.Equal(t, map[string]int{"a": 8}, getZones(t, u, 8))
+
+	// no usable IP in local zone
+	ipwcs[1].healthy.Store(false)
+	assert.Equal(t, map[string]int{"b": 8}, getZones(t, u, 8))
+	st := u.Status()
+	assert.True(t, st.Spillover)
+	assert.Equal(t, "a", st.LocalZone)
+	assert.Equal(t, "a", st.IPs[0].Zone)
+
+	ipwcs[0].healthy.Store(true)
+	ipwcs[1].healthy.Store(true)
+	assert.Equal(t, map[string]int{"a": 8}, getZones(t, u, 8))
+	assert.False(t, u.Status().Spillover)
+
+	// retry excluded local IPs
+	_, ipwc, err := u.Get(nil, &IPwc{origin: ipwcs[0]}, &IPwc{origin: ipwcs[1]})
+	assert.NoError(t, err)
+	assert.Equal(t, "b", ipwc.origin.zone)
+	u.Release(ipwc)
+}
+
+func TestZoneSpillover(t *testing.T) {
+	u, ipwcs := newZoneUpstream(t, ZoneConfig{Local: "a", MinHealthyPercent: 100})
+	ipwcs[0].healthy.Store(false)
+	assert.Equal(t, map[string]int{"a": 4, "b": 8}, getZones(t, u, 12), "spill over to all zones")
+
+	// local zone is saturated after 4 requests. then least busy IPs of all zones
+	u, _ = newZoneUpstream(t, ZoneConfig{Local: "a", MaxBusy: 2})
+	assert.Equal(t, map[string]int{"a": 6, "b": 6}, getZones(t, u, 12))
+
+	// local zone at concurrency limit
+	u, _ = newZoneUpstream(t, ZoneConfig{Local: "a"})
+	u.concurrency = &ConcurrencyConfig{MaxRequests: 1}
+	for _, ipwc := range u.IPwcs() {
+		ipwc.limiter = newLimiter(u.concurrency)
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, getZones(t, u, 4))
+}
+
+func TestSpilloverHysteresis(t *testing.T) {
+	u, ipwcs := newZoneUpstream(t, ZoneConfig{Local: "a", MaxBusy: 10})
+	local := ipwcs[:2]
+	now := time.Now()
+	setBusy := func(n int64) {
+		for _, ipwc := range local {
+			ipwc.busy.Store(n)
+		}
+	}
+	setBusy(10)
+	assert.True(t, u.shortOfCapacity(local, now, false))
+	// stays spilled until in-flight requests fall below 80% of max_busy
+	setBusy(9)
+	assert.False(t, u.shortOfCapacity(local, now, false))
+	assert.True(t, u.shortOfCapacity(local, now, true))
+	setBusy(7)
+	assert.False(t, u.shortOfCapacity(local, now, true))
+
+	// transitions are logged at most once in the interval
+	core, logs := observer.New(zap.InfoLevel)
+	u.logger = zap.New(core)
+	for i := 0; i < 100; i++ {
+		u.logSpill(i%2 == 0, now)
+	}
+	assert.Equal(t, 1, logs.Len())
+	u.logSpill(true, now.Add(spillLogInterval))
+	assert.Equal(t, 2, logs.Len())
+	assert.Equal(t, int64(100), logs.All()[1].ContextMap()["transitions"])
+}
+
+func TestZoneConfig(t *testing.T) {
+	cfg := Config{}
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+name: api
+url: http://api.internal:8080/
+members:
+  - 192.0.2.1
+  - host: 192.0.2.2
+    zone: b
+  - 198.51.100.1
+zone:
+  local: a
+  cidrs:
+    192.0.2.0/24: a
+`), &cfg))
+	u, err := New(cfg, zap.NewNop())
+	assert.NoError(t, err)
+	zones := map[string]string{}
+	for _, ipwc := range u.IPwcs() {
+		zones[ipwc.ip] = ipwc.zone
+	}
+	assert.Equal(t, map[string]string{"192.0.2.1": "a", "192.0.2.2": "b", "198.51.100.1": ""}, zones)
+}